@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// JSON REST API for scripted alias provisioning, mounted under
+// /api/v1/domains/:domain and sharing the validation and map file rewrite
+// logic of Change
+
+type APIError struct {
+	Error     string         `json:"error"`
+	Results   []ChangeResult `json:"results,omitempty"`
+	Conflicts []string       `json:"conflicts,omitempty"`
+}
+
+type APIResults struct {
+	Results []ChangeResult `json:"results"`
+	Preview *Preview       `json:"preview,omitempty"`
+	Job     *Job           `json:"job,omitempty"`
+}
+
+func apiError(c echo.Context, status int, msg string) error {
+	return c.JSON(status, APIError{Error: msg})
+}
+
+// APIDomain makes the domain in the URL the one the request applies to, if
+// the user has a role on it
+func APIDomain(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if setDomain(c, c.Param("domain")) != nil {
+			return apiError(c, http.StatusForbidden, "not authorized for domain "+c.Param("domain"))
+		}
+		return next(c)
+	}
+}
+
+// aliasParam returns the fully qualified alias from the URL, a bare local
+// part is qualified with the domain
+func aliasParam(c echo.Context, domain Domain) string {
+	alias := c.Param("alias")
+	if unescaped, err := url.PathUnescape(alias); err == nil {
+		alias = unescaped
+	}
+	return qualifyAlias(alias, domain)
+}
+
+func qualifyAlias(alias string, domain Domain) string {
+	alias = strings.TrimSpace(alias)
+	if !strings.ContainsRune(alias, '@') {
+		alias = alias + "@" + domain.Name
+	}
+	return alias
+}
+
+func findAlias(aliases []Alias, alias string) (Alias, bool) {
+	for _, a := range aliases {
+		if a.Email == alias {
+			return a, true
+		}
+	}
+	return Alias{}, false
+}
+
+func setETag(c echo.Context, version string) {
+	c.Response().Header().Set("ETag", "\""+version+"\"")
+}
+
+// ifMatch returns the map version from the If-Match request header, "*"
+// explicitly opts out of concurrency control
+func ifMatch(c echo.Context) string {
+	etag := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, "\"")
+}
+
+// checkIfMatch returns the current aliases the user can see if the client's
+// If-Match version is current, otherwise an HTTP error listing the conflicts.
+//
+// The caller must hold the map lock, see lockMap.
+func checkIfMatch(c echo.Context, domain Domain) ([]Alias, error) {
+	version := ifMatch(c)
+	if version == "*" {
+		_, version, _ = currentAliases(domain)
+	}
+	conflicts, err := checkVersion(domain, version, requestScope(c))
+	switch err {
+	case nil:
+		aliases, err := domainAliases(domain)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, APIError{Error: err.Error()})
+		}
+		return requestScope(c).filter(aliases), nil
+	case ErrMissingVersion:
+		return nil, echo.NewHTTPError(http.StatusPreconditionRequired, APIError{Error: "missing If-Match header with the map version from the ETag"})
+	case ErrStaleVersion:
+		audit(c, "change", nil, nil, err)
+		return nil, echo.NewHTTPError(http.StatusConflict, APIError{Error: err.Error(), Conflicts: conflicts})
+	}
+	return nil, echo.NewHTTPError(http.StatusInternalServerError, APIError{Error: err.Error()})
+}
+
+func apiLockError(c echo.Context, err error) error {
+	if err == ErrMapBusy {
+		c.Response().Header().Set(echo.HeaderRetryAfter, "5")
+		return apiError(c, http.StatusServiceUnavailable, err.Error())
+	}
+	return apiError(c, http.StatusInternalServerError, err.Error())
+}
+
+// dryRun is true if the client only wants a preview of the changes
+func dryRun(c echo.Context) bool {
+	dry_run, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+	return dry_run
+}
+
+// apiApply runs changes through the same pipeline as Change and reports
+// the per-alias results. The caller must hold the map lock.
+func apiApply(c echo.Context, domain Domain, status int, changes []ChangeRequest) error {
+	log.Println("Received API changes", changes)
+	remap, results, err := prepareChanges(domain, changes, requestScope(c))
+	if errors.Is(err, ErrInvalidChanges) {
+		audit(c, "change", results, nil, err)
+		return c.JSON(http.StatusUnprocessableEntity, APIError{Error: firstError(results), Results: results})
+	}
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, err.Error())
+	}
+	if dryRun(c) {
+		preview, err := previewChanges(domain, remap)
+		if err != nil {
+			return apiError(c, http.StatusInternalServerError, err.Error())
+		}
+		if !requestScope(c).whole() {
+			// the context of the diffs would show other aliases
+			return c.JSON(http.StatusOK, APIResults{Results: results})
+		}
+		return c.JSON(http.StatusOK, APIResults{Results: results, Preview: &preview})
+	}
+	steps, err := commitChanges(domain, remap)
+	audit(c, "change", results, steps, err)
+	if err != nil {
+		log.Println("could not commit API changes:", err)
+		return c.JSON(http.StatusInternalServerError, APIError{Error: err.Error(), Results: results})
+	}
+	recordHistory(c, domain, results, "")
+	job := enqueuePostProcessing(c, domain)
+	c.Response().Header().Set("X-Job-ID", job.ID)
+	if version, err := mapVersion(domain); err == nil {
+		setETag(c, version)
+	}
+	if status == http.StatusNoContent {
+		return c.NoContent(status)
+	}
+	return c.JSON(status, APIResults{Results: results, Job: &job})
+}
+
+func APIListAliases(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	unlock, err := lockMap(domain, false)
+	if err != nil {
+		return apiLockError(c, err)
+	}
+	aliases, version, err := currentAliases(domain)
+	unlock()
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, err.Error())
+	}
+	setETag(c, version)
+	return c.JSON(http.StatusOK, requestScope(c).filter(aliases))
+}
+
+func APIGetAlias(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	alias := aliasParam(c, domain)
+	unlock, err := lockMap(domain, false)
+	if err != nil {
+		return apiLockError(c, err)
+	}
+	aliases, version, err := currentAliases(domain)
+	unlock()
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, err.Error())
+	}
+	setETag(c, version)
+	a, ok := findAlias(requestScope(c).filter(aliases), alias)
+	if !ok {
+		return apiError(c, http.StatusNotFound, "no such alias: "+alias)
+	}
+	return c.JSON(http.StatusOK, a)
+}
+
+func APICreateAlias(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	var a Alias
+	if err := c.Bind(&a); err != nil {
+		return apiError(c, http.StatusBadRequest, "could not decode alias: "+err.Error())
+	}
+	alias := qualifyAlias(a.Email, domain)
+
+	unlock, err := lockMap(domain, true)
+	if err != nil {
+		return apiLockError(c, err)
+	}
+	defer unlock()
+	aliases, err := checkIfMatch(c, domain)
+	if err != nil {
+		return err
+	}
+	if _, ok := findAlias(aliases, alias); ok {
+		return apiError(c, http.StatusConflict, "alias already exists: "+alias)
+	}
+	return apiApply(c, domain, http.StatusCreated, []ChangeRequest{{"add", alias, strings.TrimSpace(a.Target)}})
+}
+
+func APIUpdateAlias(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	alias := aliasParam(c, domain)
+	var a Alias
+	if err := c.Bind(&a); err != nil {
+		return apiError(c, http.StatusBadRequest, "could not decode alias: "+err.Error())
+	}
+
+	unlock, err := lockMap(domain, true)
+	if err != nil {
+		return apiLockError(c, err)
+	}
+	defer unlock()
+	aliases, err := checkIfMatch(c, domain)
+	if err != nil {
+		return err
+	}
+	if _, ok := findAlias(aliases, alias); !ok {
+		return apiError(c, http.StatusNotFound, "no such alias: "+alias)
+	}
+	return apiApply(c, domain, http.StatusOK, []ChangeRequest{{"add", alias, strings.TrimSpace(a.Target)}})
+}
+
+func APIDeleteAlias(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	alias := aliasParam(c, domain)
+
+	unlock, err := lockMap(domain, true)
+	if err != nil {
+		return apiLockError(c, err)
+	}
+	defer unlock()
+	aliases, err := checkIfMatch(c, domain)
+	if err != nil {
+		return err
+	}
+	if _, ok := findAlias(aliases, alias); !ok {
+		return apiError(c, http.StatusNotFound, "no such alias: "+alias)
+	}
+	return apiApply(c, domain, http.StatusNoContent, []ChangeRequest{{"remove", alias, ""}})
+}
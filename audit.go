@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Append-only audit log in JSON lines format, one event per alias change,
+// restore or failed authentication attempt
+
+type AuditEvent struct {
+	Time      time.Time      `json:"time"`
+	Event     string         `json:"event"`
+	Domain    string         `json:"domain,omitempty"`
+	User      string         `json:"user,omitempty"`
+	Client    string         `json:"client"`
+	RequestID string         `json:"request_id,omitempty"`
+	Outcome   string         `json:"outcome"`
+	Error     string         `json:"error,omitempty"`
+	Changes   []ChangeResult `json:"changes,omitempty"`
+	Steps     []Step         `json:"steps,omitempty"`
+}
+
+// how many events the viewer shows
+const auditViewMax = 500
+
+var audit_log = struct {
+	sync.Mutex
+	f *os.File
+}{}
+
+func openAuditLog(file_name string) {
+	if file_name == "" {
+		return
+	}
+	f, err := os.OpenFile(file_name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Fatal("could not open audit log ", file_name, " due to ", err)
+	}
+	audit_log.f = f
+}
+
+func writeAudit(event AuditEvent) {
+	audit_log.Lock()
+	defer audit_log.Unlock()
+	if audit_log.f == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Println("could not marshal audit event", event, "due to", err)
+		return
+	}
+	_, err = audit_log.f.Write(append(line, '\n'))
+	if err != nil {
+		log.Println("could not write audit event", string(line), "due to", err)
+	}
+}
+
+// audit records an event for the authenticated domain of the request
+func audit(c echo.Context, event string, results []ChangeResult, steps []Step, err error) {
+	domain := c.Get("domain").(Domain)
+	e := AuditEvent{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		Domain:    domain.Name,
+		User:      principal(c),
+		Client:    c.RealIP(),
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+		Outcome:   "ok",
+		Changes:   results,
+		Steps:     steps,
+	}
+	if err != nil {
+		e.Outcome = "error"
+		e.Error = err.Error()
+		if err == ErrInvalidChanges || err == ErrStaleVersion || err == ErrMissingVersion {
+			e.Outcome = "rejected"
+		}
+	}
+	writeAudit(e)
+}
+
+// auditAuthFailure records a failed authentication attempt, attributed to
+// the domain if the user name is one
+func auditAuthFailure(c echo.Context, user string) {
+	domain := ""
+	for _, d := range conf.Domains {
+		if d.Name == user {
+			domain = d.Name
+		}
+	}
+	writeAudit(AuditEvent{
+		Time:      time.Now().UTC(),
+		Event:     "auth",
+		Domain:    domain,
+		User:      user,
+		Client:    c.RealIP(),
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+		Outcome:   "rejected",
+	})
+}
+
+// readAudit returns the most recent events for a domain, newest first
+func readAudit(domain Domain) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+	if conf.AuditLog == "" {
+		return events, nil
+	}
+	f, err := os.Open(conf.AuditLog)
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || event.Domain != domain.Name {
+			continue
+		}
+		events = append(events, event)
+		if len(events) > 2*auditViewMax {
+			events = append(events[:0], events[len(events)-auditViewMax:]...)
+		}
+	}
+	if len(events) > auditViewMax {
+		events = events[len(events)-auditViewMax:]
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, scanner.Err()
+}
+
+func Audit(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	events, err := readAudit(domain)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "audit", struct {
+		Domain  string
+		Enabled bool
+		Events  []AuditEvent
+	}{domain.Name, conf.AuditLog != "", events})
+}
+
+func APIAudit(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	events, err := readAudit(domain)
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Map backends compile the text map files into the lookup tables Postfix
+// actually reads. Each domain declares the type of its map with MapType in
+// the config file, the same name as used in Postfix's main.cf, e.g.
+// virtual_alias_maps = cdb:/etc/postfix/domains/example.com
+
+// MapBackend compiles a text map file for one Postfix lookup table type
+type MapBackend interface {
+	// Name identifies the backend in the steps reported to users
+	Name() string
+	// Compile builds the lookup table for a text map file next to it
+	Compile(map_file string) error
+	// Suffixes are appended to the text map file name to get the files
+	// Compile creates
+	Suffixes() []string
+}
+
+const defaultMapType = "hash"
+
+// postmapBackend runs postmap, for the table types only Postfix knows how
+// to build
+type postmapBackend struct {
+	map_type string
+	suffixes []string
+}
+
+func (b postmapBackend) Name() string {
+	return "postmap"
+}
+
+func (b postmapBackend) Compile(map_file string) error {
+	cmd := exec.Command("postmap", b.map_type+":"+map_file)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (b postmapBackend) Suffixes() []string {
+	return b.suffixes
+}
+
+// textBackend is for texthash: tables, which Postfix reads directly from the
+// text map file, and maps served by postmapweb's own socketmap server
+type textBackend struct {
+	map_type string
+}
+
+func (b textBackend) Name() string {
+	return b.map_type
+}
+
+func (b textBackend) Compile(map_file string) error {
+	return nil
+}
+
+func (b textBackend) Suffixes() []string {
+	return nil
+}
+
+// mapBackend returns the backend for the domain's map type
+func mapBackend(domain Domain) (MapBackend, error) {
+	switch domain.MapType {
+	case "", "hash", "btree":
+		map_type := domain.MapType
+		if map_type == "" {
+			map_type = defaultMapType
+		}
+		return postmapBackend{map_type, []string{".db"}}, nil
+	case "lmdb":
+		return postmapBackend{"lmdb", []string{".lmdb"}}, nil
+	case "dbm", "sdbm":
+		return postmapBackend{domain.MapType, []string{".dir", ".pag"}}, nil
+	case "cdb":
+		return cdbBackend{}, nil
+	case "texthash", "socketmap":
+		return textBackend{domain.MapType}, nil
+	}
+	return nil, fmt.Errorf("unsupported map type %q for %s", domain.MapType, domain.Name)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// Native writer for cdb: tables, so they can be built without the Postfix
+// tools. The format is D. J. Bernstein's constant database, see
+// https://cr.yp.to/cdb/cdb.txt
+
+var ErrCDBTooLarge = errors.New("cdb files are limited to 4GB")
+
+// cdbBackend compiles map files to <map file>.cdb like postmap would
+type cdbBackend struct{}
+
+func (b cdbBackend) Name() string {
+	return "cdb"
+}
+
+func (b cdbBackend) Compile(map_file string) error {
+	f, err := os.Open(map_file)
+	if err != nil {
+		return err
+	}
+	keys, values, err := parseMapEntries(f, map_file, true)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return writeCDB(map_file+".cdb", keys, values)
+}
+
+func (b cdbBackend) Suffixes() []string {
+	return []string{".cdb"}
+}
+
+// parseMapEntries parses a text map the way postmap does: comments and
+// blank lines are skipped, lines starting with whitespace continue the
+// previous line, and the first of keys differing only in case wins. Keys are
+// folded to lower case if fold is set.
+func parseMapEntries(r io.Reader, map_file string, fold bool) ([]string, []string, error) {
+	keys := make([]string, 0)
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(line string) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			log.Println(map_file+": expected format: key whitespace value, skipping", line)
+			return
+		}
+		key := line[:i]
+		if seen[strings.ToLower(key)] {
+			log.Println(map_file+": duplicate entry:", key)
+			return
+		}
+		seen[strings.ToLower(key)] = true
+		if fold {
+			key = strings.ToLower(key)
+		}
+		keys = append(keys, key)
+		values = append(values, strings.TrimSpace(line[i:]))
+	}
+	var logical string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			logical += " " + trimmed
+			continue
+		}
+		add(logical)
+		logical = line
+	}
+	add(logical)
+	return keys, values, scanner.Err()
+}
+
+func cdbHash(key string) uint32 {
+	h := uint32(5381)
+	for i := 0; i < len(key); i++ {
+		h = ((h << 5) + h) ^ uint32(key[i])
+	}
+	return h
+}
+
+// writeCDB writes the records to a new cdb file
+func writeCDB(file_name string, keys []string, values []string) error {
+	type slot struct {
+		hash uint32
+		pos  uint32
+	}
+	var buckets [256][]slot
+	// header of 256 hash table pointers, then the records
+	size := uint64(256 * 8)
+	for i, key := range keys {
+		h := cdbHash(key)
+		buckets[h&0xff] = append(buckets[h&0xff], slot{h, uint32(size)})
+		size += 8 + uint64(len(key)) + uint64(len(values[i]))
+		if size > math.MaxUint32 {
+			return ErrCDBTooLarge
+		}
+	}
+	f, err := os.Create(file_name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	header := make([]byte, 256*8)
+	w.Write(header)
+	buf := make([]byte, 8)
+	for i, key := range keys {
+		binary.LittleEndian.PutUint32(buf, uint32(len(key)))
+		binary.LittleEndian.PutUint32(buf[4:], uint32(len(values[i])))
+		w.Write(buf)
+		w.WriteString(key)
+		w.WriteString(values[i])
+	}
+	// hash tables, twice as many slots as records with linear probing
+	for b, bucket := range buckets {
+		n := uint32(2 * len(bucket))
+		binary.LittleEndian.PutUint32(header[b*8:], uint32(size))
+		binary.LittleEndian.PutUint32(header[b*8+4:], n)
+		table := make([]slot, n)
+		for _, s := range bucket {
+			i := (s.hash >> 8) % n
+			for table[i].pos != 0 {
+				i = (i + 1) % n
+			}
+			table[i] = s
+		}
+		for _, s := range table {
+			binary.LittleEndian.PutUint32(buf, s.hash)
+			binary.LittleEndian.PutUint32(buf[4:], s.pos)
+			w.Write(buf)
+		}
+		size += 8 * uint64(n)
+		if size > math.MaxUint32 {
+			f.Close()
+			return ErrCDBTooLarge
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		_, err = f.WriteAt(header, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Dashboard of all the configured domains, for the admins of all domains
+// (users granted admin on "*"), from which they can open any domain's
+// aliases without logging in again.
+
+// DomainSummary is the state of a domain on the dashboard
+type DomainSummary struct {
+	Domain  string `json:"domain"`
+	MapType string `json:"map_type"`
+	Aliases int    `json:"aliases"`
+	Spam    int    `json:"spam"`
+	// time of the last change made through postmapweb, or else of the last
+	// modification of the map file
+	LastChange   time.Time `json:"last_change"`
+	LastChangeBy string    `json:"last_change_by,omitempty"`
+	// map files that are missing or not compiled, and errors reading them
+	Problems []string `json:"problems"`
+}
+
+// summarizeDomain counts the domain's aliases and checks its map files
+func summarizeDomain(d Domain) DomainSummary {
+	summary := DomainSummary{
+		Domain:   d.Name,
+		MapType:  d.MapType,
+		Problems: mapProblems(d, make(map[string]bool)),
+	}
+	if summary.MapType == "" {
+		summary.MapType = defaultMapType
+	}
+	if summary.Problems == nil {
+		summary.Problems = make([]string, 0)
+	}
+	unlock, err := lockMap(d, false)
+	if err != nil {
+		summary.Problems = append(summary.Problems, err.Error())
+		return summary
+	}
+	aliases, err := domainAliases(d)
+	unlock()
+	if err != nil {
+		summary.Problems = append(summary.Problems, "could not read the map: "+err.Error())
+	}
+	for _, a := range aliases {
+		if is_spam(a.Target) {
+			summary.Spam++
+		} else {
+			summary.Aliases++
+		}
+	}
+	revs, err := listRevisions(d)
+	if err == nil && len(revs) > 0 {
+		summary.LastChange = revs[0].Time
+		summary.LastChangeBy = revs[0].User
+	} else if info, err := os.Stat(d.MapFile); err == nil {
+		summary.LastChange = info.ModTime().UTC()
+	}
+	return summary
+}
+
+func summarizeDomains() []DomainSummary {
+	summaries := make([]DomainSummary, 0, len(conf.Domains))
+	for _, d := range conf.Domains {
+		summaries = append(summaries, summarizeDomain(d))
+	}
+	return summaries
+}
+
+func Dashboard(c echo.Context) error {
+	return c.Render(http.StatusOK, "dashboard", struct {
+		User    string
+		Domains []DomainSummary
+	}{principal(c), summarizeDomains()})
+}
+
+func APIDashboard(c echo.Context) error {
+	return c.JSON(http.StatusOK, summarizeDomains())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Minimal line-based unified diff, used to preview map file rewrites
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// edit distance beyond which diffLines gives up looking for the shortest
+// edit script, and just replaces the changed lines, to bound its memory use
+const maxDiffEdits = 1000
+
+// diffLines computes the shortest edit script from a to b using Myers'
+// algorithm, see: http://www.xmailserver.org/diff2.pdf
+func diffLines(a []string, b []string) []diffOp {
+	// leave out the common prefix and suffix
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// diffMiddle is diffLines without the common prefix and suffix
+func diffMiddle(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// the part of v used by each round d, v[offset-d-1:offset+d+2], so
+	// memory grows with the square of the edit distance only
+	trace := make([][]int, 0)
+	found := false
+search:
+	for d := 0; d <= max && d <= maxDiffEdits; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break search
+			}
+		}
+	}
+	ops := make([]diffOp, 0, max)
+	if !found {
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+	// backtrack through the trace to recover the edit script
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		// index of diagonal k in v
+		at := func(k int) int { return v[k+d+1] }
+		k := x - y
+		var prev_k int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prev_k = k + 1
+		} else {
+			prev_k = k - 1
+		}
+		prev_x := at(prev_k)
+		prev_y := prev_x - prev_k
+		for x > prev_x && y > prev_y {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prev_x {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prev_x, prev_y
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff returns the differences between the old and new contents of
+// a file in unified diff format with 3 lines of context, or the empty
+// string if they are identical
+func unifiedDiff(name string, old string, new string) string {
+	const context = 3
+	ops := diffLines(splitLines(old), splitLines(new))
+	// line numbers in the old and new file before each op
+	a_line := make([]int, len(ops)+1)
+	b_line := make([]int, len(ops)+1)
+	for i, op := range ops {
+		a_line[i+1], b_line[i+1] = a_line[i], b_line[i]
+		if op.kind != '+' {
+			a_line[i+1]++
+		}
+		if op.kind != '-' {
+			b_line[i+1]++
+		}
+	}
+	var out strings.Builder
+	i := 0
+	for i < len(ops) {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		if out.Len() == 0 {
+			out.WriteString("--- " + name + "\n+++ " + name + "\n")
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// merge changes separated by less than twice the context
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			j := end
+			for j < len(ops) && ops[j].kind == ' ' {
+				j++
+			}
+			if j == len(ops) || j-end > 2*context {
+				end += context
+				if end > len(ops) {
+					end = len(ops)
+				}
+				break
+			}
+			end = j
+		}
+		a_count := a_line[end] - a_line[start]
+		b_count := b_line[end] - b_line[start]
+		a_start, b_start := a_line[start], b_line[start]
+		if a_count > 0 {
+			a_start++
+		}
+		if b_count > 0 {
+			b_start++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", a_start, a_count, b_start, b_count)
+		for _, op := range ops[start:end] {
+			out.WriteString(string(op.kind) + op.line + "\n")
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// DiffLine is a line of a unified diff with its CSS class for display
+type DiffLine struct {
+	Class string
+	Text  string
+}
+
+func diffRows(diff string) []DiffLine {
+	rows := make([]DiffLine, 0)
+	for i, line := range splitLines(diff) {
+		class := ""
+		switch {
+		case i < 2:
+			class = "file"
+		case strings.HasPrefix(line, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(line, "+"):
+			class = "add"
+		case strings.HasPrefix(line, "-"):
+			class = "del"
+		}
+		rows = append(rows, DiffLine{class, line})
+	}
+	return rows
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Versioned history of the map files: after every successful change, a
+// snapshot of the domain's entries in the map and spam map files is saved
+// along with who made the change and what it was, so any earlier version can
+// be inspected and restored. Other domains sharing the map file are neither
+// saved nor touched by a restore.
+
+// Revision is the metadata of a snapshot of a domain's map files
+type Revision struct {
+	ID      string         `json:"id"`
+	Time    time.Time      `json:"time"`
+	User    string         `json:"user"`
+	Client  string         `json:"client"`
+	Comment string         `json:"comment,omitempty"`
+	Changes []ChangeResult `json:"changes,omitempty"`
+}
+
+const (
+	defaultHistoryKeep = 100
+	revisionIDFormat   = "20060102T150405.000000000Z"
+)
+
+var ErrNoSuchRevision = errors.New("no such revision")
+
+// historyDir returns the directory holding the domain's snapshots, by
+// default next to its map file
+func historyDir(domain Domain) string {
+	if conf.HistoryDir != "" {
+		return filepath.Join(conf.HistoryDir, domain.Name)
+	}
+	return filepath.Join(domain.MapFile+".history", domain.Name)
+}
+
+func revisionDir(domain Domain, id string) (string, error) {
+	if _, err := time.Parse(revisionIDFormat, id); err != nil {
+		return "", ErrNoSuchRevision
+	}
+	return filepath.Join(historyDir(domain), id), nil
+}
+
+// principal identifies who is making a request
+func principal(c echo.Context) string {
+	return c.Get("user").(User).Name
+}
+
+// saveRevision saves a revision with the domain's entries of the map and
+// spam map contents
+func saveRevision(domain Domain, rev Revision, map_data []byte, spam_data []byte) error {
+	dir, err := revisionDir(domain, rev.ID)
+	if err != nil {
+		return err
+	}
+	map_data, spam_data, err = domainEntries(domain, map_data, spam_data)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "map"), map_data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "spam"), spam_data, 0644)
+	if err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "meta.json"), meta, 0644)
+}
+
+// listRevisions returns the domain's revisions, most recent first
+func listRevisions(domain Domain) ([]Revision, error) {
+	entries, err := os.ReadDir(historyDir(domain))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]Revision, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rev, err := loadRevisionMeta(domain, entry.Name())
+		if err != nil {
+			log.Println("skipping unreadable revision", entry.Name(), "of", domain.Name, "due to", err)
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].ID > revs[j].ID })
+	return revs, nil
+}
+
+func loadRevisionMeta(domain Domain, id string) (Revision, error) {
+	var rev Revision
+	dir, err := revisionDir(domain, id)
+	if err != nil {
+		return rev, err
+	}
+	meta, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+	if os.IsNotExist(err) {
+		return rev, ErrNoSuchRevision
+	}
+	if err != nil {
+		return rev, err
+	}
+	err = json.Unmarshal(meta, &rev)
+	return rev, err
+}
+
+// loadRevision returns a revision's metadata and the domain's entries of
+// the map and spam map contents
+func loadRevision(domain Domain, id string) (Revision, []byte, []byte, error) {
+	rev, err := loadRevisionMeta(domain, id)
+	if err != nil {
+		return rev, nil, nil, err
+	}
+	dir, _ := revisionDir(domain, id)
+	map_data, err := os.ReadFile(filepath.Join(dir, "map"))
+	if err != nil {
+		return rev, nil, nil, err
+	}
+	spam_data, err := os.ReadFile(filepath.Join(dir, "spam"))
+	if err != nil {
+		return rev, nil, nil, err
+	}
+	// older snapshots have the whole map files
+	map_data, spam_data, err = domainEntries(domain, map_data, spam_data)
+	return rev, map_data, spam_data, err
+}
+
+// mapTargets returns the targets of the domain's aliases in map and spam map
+// contents, as written in the map files
+func mapTargets(domain Domain, map_data []byte, spam_data []byte) (map[string]string, error) {
+	targets := make(map[string]string)
+	hook := func(line string, email string) {
+		if inDomain(email, domain) {
+			targets[email] = strings.Join(strings.Fields(line)[1:], " ")
+		}
+	}
+	_, err := readSingleMap(map_data, false, hook)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readSingleMap(spam_data, true, hook)
+	return targets, err
+}
+
+// restoreRemap returns the rewrite table that turns the domain's current
+// aliases back into those of a revision.
+//
+// The caller must hold the map lock, see lockMap.
+func restoreRemap(domain Domain, map_data []byte, spam_data []byte) (map[string]string, error) {
+	old, err := mapTargets(domain, map_data, spam_data)
+	if err != nil {
+		return nil, err
+	}
+	cur_map, cur_spam, err := loadMaps(domain)
+	if err != nil {
+		return nil, err
+	}
+	current, err := mapTargets(domain, cur_map, cur_spam)
+	if err != nil {
+		return nil, err
+	}
+	remap := make(map[string]string)
+	for email := range current {
+		if _, ok := old[email]; !ok {
+			remap[email] = ""
+		}
+	}
+	for email, target := range old {
+		if current[email] != target {
+			remap[email] = target
+		}
+	}
+	return remap, nil
+}
+
+// pruneHistory enforces the retention policy, the most recent revision is
+// always kept
+func pruneHistory(domain Domain) {
+	revs, err := listRevisions(domain)
+	if err != nil {
+		log.Println("could not list history of", domain.Name, "due to", err)
+		return
+	}
+	keep := conf.HistoryKeep
+	if keep <= 0 {
+		keep = defaultHistoryKeep
+	}
+	for i, rev := range revs {
+		expired := conf.HistoryMaxDays > 0 && time.Since(rev.Time) > time.Duration(conf.HistoryMaxDays)*24*time.Hour
+		if i == 0 || (i < keep && !expired) {
+			continue
+		}
+		dir, _ := revisionDir(domain, rev.ID)
+		err = os.RemoveAll(dir)
+		if err != nil {
+			log.Println("could not prune revision", rev.ID, "of", domain.Name, "due to", err)
+		}
+	}
+}
+
+// recordHistory snapshots the domain's freshly installed map files. The
+// first time, the previous version left behind by installMaps is also
+// saved so the change can be undone. Failures are logged but not reported,
+// as the change itself has been committed.
+//
+// The caller must hold the map lock, see lockMap.
+func recordHistory(c echo.Context, domain Domain, results []ChangeResult, comment string) {
+	revs, err := listRevisions(domain)
+	if err != nil {
+		log.Println("could not list history of", domain.Name, "due to", err)
+		return
+	}
+	if len(revs) == 0 {
+		old_map, err := os.ReadFile(domain.MapFile + ".old")
+		if err == nil {
+			old_spam, _ := os.ReadFile(domain.MapFile + ".spam.old")
+			now := time.Now().UTC()
+			rev := Revision{ID: now.Format(revisionIDFormat), Time: now, Comment: "initial version"}
+			err = saveRevision(domain, rev, old_map, old_spam)
+			if err != nil {
+				log.Println("could not save initial revision of", domain.Name, "due to", err)
+			}
+		}
+	}
+	map_data, spam_data, err := loadMaps(domain)
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	rev := Revision{
+		ID:      now.Format(revisionIDFormat),
+		Time:    now,
+		User:    principal(c),
+		Client:  c.RealIP(),
+		Comment: comment,
+		Changes: results,
+	}
+	err = saveRevision(domain, rev, map_data, spam_data)
+	if err != nil {
+		log.Println("could not save revision of", domain.Name, "due to", err)
+		return
+	}
+	pruneHistory(domain)
+}
+
+// RevisionPage is the data for the revision template
+type RevisionPage struct {
+	Domain   string
+	Revision Revision
+	Against  string
+	Version  string
+	Map      []DiffLine
+	Spam     []DiffLine
+	CSRF     string
+}
+
+func History(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	revs, err := listRevisions(domain)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "history", struct {
+		Domain    string
+		Revisions []Revision
+	}{domain.Name, revs})
+}
+
+// HistoryRevision shows the changes in a revision compared to the previous
+// one, or to the current map files with ?against=current
+func HistoryRevision(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	unlock, err := lockMap(domain, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	rev, map_data, spam_data, err := loadRevision(domain, c.Param("id"))
+	if err == ErrNoSuchRevision {
+		return c.Render(http.StatusNotFound, "error", ErrorPage{"no such revision: " + c.Param("id"), nil})
+	}
+	if err != nil {
+		return err
+	}
+	_, version, err := currentAliases(domain)
+	if err != nil {
+		return err
+	}
+	var against string
+	var old_map, old_spam []byte
+	if c.QueryParam("against") == "current" {
+		// show what restoring the revision would do
+		against = "current"
+		old_map, old_spam, err = loadMaps(domain)
+		if err != nil {
+			return err
+		}
+		old_map, old_spam, err = domainEntries(domain, old_map, old_spam)
+		if err != nil {
+			return err
+		}
+	} else {
+		revs, err := listRevisions(domain)
+		if err != nil {
+			return err
+		}
+		for _, prev := range revs {
+			if prev.ID < rev.ID {
+				against = prev.ID
+				_, old_map, old_spam, err = loadRevision(domain, prev.ID)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	name := filepath.Base(domain.MapFile)
+	return c.Render(http.StatusOK, "revision", RevisionPage{
+		domain.Name,
+		rev,
+		against,
+		version,
+		diffRows(unifiedDiff(name, string(old_map), string(map_data))),
+		diffRows(unifiedDiff(name+".spam", string(old_spam), string(spam_data))),
+		csrfToken(c),
+	})
+}
+
+// Restore brings the domain's aliases back to an earlier revision through
+// the same pipeline as Change, merging them into the current map files
+func Restore(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	unlock, err := lockMap(domain, true)
+	if err == ErrMapBusy {
+		c.Response().Header().Set(echo.HeaderRetryAfter, "5")
+		return c.Render(http.StatusServiceUnavailable, "error", ErrorPage{err.Error(), nil})
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conflicts, err := checkVersion(domain, c.FormValue("version"), requestScope(c))
+	switch err {
+	case nil:
+	case ErrMissingVersion:
+		return c.Render(http.StatusPreconditionRequired, "error", ErrorPage{err.Error(), nil})
+	case ErrStaleVersion:
+		return c.Render(http.StatusConflict, "error", ErrorPage{err.Error(), conflicts})
+	default:
+		return err
+	}
+	rev, map_data, spam_data, err := loadRevision(domain, c.Param("id"))
+	if err == ErrNoSuchRevision {
+		return c.Render(http.StatusNotFound, "error", ErrorPage{"no such revision: " + c.Param("id"), nil})
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Restoring revision", rev.ID, "of", domain.Name)
+	remap, err := restoreRemap(domain, map_data, spam_data)
+	if err != nil {
+		return err
+	}
+	steps, err := commitChanges(domain, remap)
+	audit(c, "restore", nil, steps, err)
+	if err != nil {
+		return err
+	}
+	recordHistory(c, domain, nil, "restored revision of "+rev.Time.Local().Format(time.RFC1123))
+	job := enqueuePostProcessing(c, domain)
+
+	c.Response().Header().Set("Location", "/?job="+job.ID)
+	return c.HTML(303, "<script>document.location.href = \"/?job="+job.ID+"\";</script>")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// In-memory index of the domains' maps, used by the built-in lookup servers
+// to answer Postfix's queries. It is updated as soon as changes are installed
+// or the map files are changed by other means. The virtual map holds the
+// main maps, and the access map the spam maps.
+
+// entries of the main and spam maps of a map file, keyed by the folded key
+type mapIndex struct {
+	virtual map[string]string
+	access  map[string]string
+}
+
+var lookup_index = struct {
+	sync.RWMutex
+	enabled bool
+	// map files in the order of the domains in the config file, the first
+	// one with a key wins
+	order []string
+	index map[string]mapIndex
+}{index: make(map[string]mapIndex)}
+
+// indexEntries returns the entries of a map, with keys folded to lower case
+// as Postfix folds lookup keys
+func indexEntries(map_file string, data []byte) (map[string]string, error) {
+	keys, values, err := parseMapEntries(bytes.NewReader(data), map_file, true)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string, len(keys))
+	for i, key := range keys {
+		entries[key] = values[i]
+	}
+	return entries, nil
+}
+
+func indexEnabled() bool {
+	lookup_index.RLock()
+	defer lookup_index.RUnlock()
+	return lookup_index.enabled
+}
+
+// indexMaps updates the index with the domain's current maps, on failure
+// the previous entries are kept.
+//
+// The caller must hold the map lock, see lockMap.
+func indexMaps(domain Domain) {
+	if !indexEnabled() {
+		return
+	}
+	map_data, spam_data, err := loadMaps(domain)
+	if err != nil {
+		return
+	}
+	virtual, err := indexEntries(domain.MapFile, map_data)
+	if err != nil {
+		log.Println("could not index the map of", domain.Name, "due to", err)
+		return
+	}
+	access, err := indexEntries(domain.MapFile+".spam", spam_data)
+	if err != nil {
+		log.Println("could not index the spam map of", domain.Name, "due to", err)
+		return
+	}
+	lookup_index.Lock()
+	lookup_index.index[domain.MapFile] = mapIndex{virtual, access}
+	lookup_index.Unlock()
+}
+
+// reindexMapFile updates the index after the watcher saw a map file change
+func reindexMapFile(map_file string) {
+	if !indexEnabled() {
+		return
+	}
+	for _, d := range conf.Domains {
+		if d.MapFile != map_file {
+			continue
+		}
+		unlock, err := lockMap(d, false)
+		if err != nil {
+			log.Println("could not reindex the map of", d.Name, "due to", err)
+			return
+		}
+		indexMaps(d)
+		unlock()
+		return
+	}
+}
+
+// startIndex builds the index of the domains' maps, the first time a lookup
+// server needs it
+func startIndex(domains []Domain) {
+	lookup_index.Lock()
+	if lookup_index.enabled {
+		lookup_index.Unlock()
+		return
+	}
+	lookup_index.enabled = true
+	for _, d := range domains {
+		if _, ok := lookup_index.index[d.MapFile]; !ok {
+			lookup_index.order = append(lookup_index.order, d.MapFile)
+			lookup_index.index[d.MapFile] = mapIndex{}
+		}
+	}
+	lookup_index.Unlock()
+	for _, d := range domains {
+		reindexMapFile(d.MapFile)
+	}
+}
+
+// lookupKey looks a key up in the virtual or access map, restricted to the
+// given map files unless map_files is nil
+func lookupKey(name string, key string, map_files []string) (string, bool) {
+	lookup_index.RLock()
+	defer lookup_index.RUnlock()
+	key = strings.ToLower(key)
+	for _, map_file := range lookup_index.order {
+		if map_files != nil && !slices.Contains(map_files, map_file) {
+			continue
+		}
+		var value string
+		var ok bool
+		switch name {
+		case "virtual":
+			value, ok = lookup_index.index[map_file].virtual[key]
+		case "access":
+			value, ok = lookup_index.index[map_file].access[key]
+		}
+		if ok {
+			return value, true
+		}
+	}
+	return "", false
+}
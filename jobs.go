@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Background post-processing: once new map files are installed, reloading
+// Postfix and running the script hook are done by a job, so requests return
+// quickly. Reloads are batched (see reload.go), hooks run with a timeout,
+// and failed steps are retried. The status of recent jobs is kept in memory
+// so the UI and API clients can follow them.
+
+const (
+	defaultHookTimeout = 60
+	defaultJobRetries  = 3
+	retryBackoff       = 5 * time.Second
+	maxJobs            = 1000
+)
+
+type Job struct {
+	ID        string     `json:"id"`
+	Domain    string     `json:"domain"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Steps     []Step     `json:"steps"`
+	Error     string     `json:"error,omitempty"`
+	user      string
+	client    string
+	requestID string
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID  map[string]*Job
+	order []string
+}{byID: make(map[string]*Job)}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// getJob returns a copy of a job's current state
+func getJob(id string) (Job, bool) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	job, ok := jobs.byID[id]
+	if !ok {
+		return Job{}, false
+	}
+	j := *job
+	j.Steps = append([]Step(nil), job.Steps...)
+	return j, true
+}
+
+func (j *Job) update(f func(j *Job)) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	f(j)
+}
+
+// enqueuePostProcessing starts a job reloading Postfix and running the
+// domain's script hook after its map files were changed
+func enqueuePostProcessing(c echo.Context, domain Domain) Job {
+	job := &Job{
+		ID:        newJobID(),
+		Domain:    domain.Name,
+		Status:    "queued",
+		Created:   time.Now().UTC(),
+		Steps:     make([]Step, 0),
+		user:      principal(c),
+		client:    c.RealIP(),
+		requestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	jobs.Lock()
+	jobs.byID[job.ID] = job
+	jobs.order = append(jobs.order, job.ID)
+	if len(jobs.order) > maxJobs {
+		delete(jobs.byID, jobs.order[0])
+		jobs.order = jobs.order[1:]
+	}
+	snapshot := *job
+	jobs.Unlock()
+	go job.run(domain)
+	return snapshot
+}
+
+// retry runs f until it succeeds or the configured number of retries is
+// exhausted, recording each attempt as a step
+func (j *Job) retry(step string, f func() error) error {
+	retries := conf.JobRetries
+	if retries <= 0 {
+		retries = defaultJobRetries
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff << (attempt - 1))
+		}
+		err = f()
+		j.update(func(j *Job) { j.Steps = append(j.Steps, newStep(step, err)) })
+		if err == nil {
+			return nil
+		}
+		log.Println(step, "for", j.Domain, "failed:", err)
+	}
+	return err
+}
+
+// runHook runs the domain's script hook with a timeout, holding the map
+// lock as scripts may rewrite the map files
+func runHook(domain Domain) error {
+	unlock, err := lockMap(domain, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	timeout := conf.HookTimeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, domain.Script, domain.Name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (j *Job) run(domain Domain) {
+	j.update(func(j *Job) { j.Status = "running" })
+	var err error
+	if store, _ := aliasStore(domain); store.NeedsReload() {
+		err = j.retry("reload", reloadPostfix)
+	}
+	// optional script hook
+	if domain.Script != "" {
+		hook_err := j.retry("script", func() error { return runHook(domain) })
+		if err == nil {
+			err = hook_err
+		}
+	}
+	finished := time.Now().UTC()
+	j.update(func(j *Job) {
+		j.Finished = &finished
+		j.Status = "done"
+		if err != nil {
+			j.Status = "failed"
+			j.Error = err.Error()
+		}
+	})
+	job, _ := getJob(j.ID)
+	event := AuditEvent{
+		Time:      finished,
+		Event:     "post-processing",
+		Domain:    job.Domain,
+		User:      j.user,
+		Client:    j.client,
+		RequestID: j.requestID,
+		Outcome:   "ok",
+		Error:     job.Error,
+		Steps:     job.Steps,
+	}
+	if err != nil {
+		event.Outcome = "error"
+	}
+	writeAudit(event)
+}
+
+// JobStatus returns the state of a post-processing job of the domain
+func JobStatus(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	job, ok := getJob(c.Param("id"))
+	if !ok || job.Domain != domain.Name {
+		return apiError(c, http.StatusNotFound, "no such job: "+c.Param("id"))
+	}
+	return c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Map files are locked both within postmapweb, and against other processes
+// using an advisory flock(2) lock on a <map file>.lock file next to them, so
+// edits made with other tools that lock it (e.g. flock(1)) or by other
+// postmapweb instances are not clobbered. The map files themselves cannot be
+// locked, as every change replaces them with new files. Each map file has its
+// own lock, so a slow postmap or script hook for one domain does not hold up
+// the others, while domains sharing a map file are still serialized.
+
+var ErrMapBusy = errors.New("the map is busy, someone else is changing it, please try again in a moment")
+
+const defaultLockTimeout = 10 * time.Second
+
+// serializes map file rewrites within this process, per map file
+var map_locks = struct {
+	sync.Mutex
+	locks map[string]*sync.RWMutex
+}{locks: make(map[string]*sync.RWMutex)}
+
+func mapMutex(map_file string) *sync.RWMutex {
+	map_locks.Lock()
+	defer map_locks.Unlock()
+	map_file = filepath.Clean(map_file)
+	lock, ok := map_locks.locks[map_file]
+	if !ok {
+		lock = new(sync.RWMutex)
+		map_locks.locks[map_file] = lock
+	}
+	return lock
+}
+
+// lockFile returns the file locked for a map file, which is never replaced
+func lockFile(map_file string) string {
+	return map_file + ".lock"
+}
+
+func lockTimeout() time.Duration {
+	if conf.LockTimeout > 0 {
+		return time.Duration(conf.LockTimeout) * time.Second
+	}
+	return defaultLockTimeout
+}
+
+// lockMap locks the domain's map files, exclusively for changes or shared
+// for reads, waiting at most the configured timeout for other processes
+// before giving up with ErrMapBusy. It returns the function to call to
+// release the lock.
+func lockMap(domain Domain, exclusive bool) (func(), error) {
+	mutex := mapMutex(domain.MapFile)
+	if exclusive {
+		mutex.Lock()
+	} else {
+		mutex.RLock()
+	}
+	release := func() {
+		if exclusive {
+			mutex.Unlock()
+		} else {
+			mutex.RUnlock()
+		}
+	}
+	f, err := flockFile(lockFile(domain.MapFile), exclusive, time.Now().Add(lockTimeout()))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		// closing the file releases the lock
+		f.Close()
+		release()
+	}, nil
+}
+
+// flockFile opens, creating it if needed, and locks a file, making sure the
+// lock is on the file currently at that path in case it was removed while
+// we waited
+func flockFile(file_name string, exclusive bool, deadline time.Time) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(file_name, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		locked, err := tryFlock(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			f_info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			path_info, err := os.Stat(file_name)
+			if err == nil && os.SameFile(f_info, path_info) {
+				return f, nil
+			}
+			f.Close()
+			continue
+		}
+		f.Close()
+		if time.Now().After(deadline) {
+			return nil, ErrMapBusy
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
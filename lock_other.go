@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || solaris)
+
+package main
+
+import (
+	"os"
+)
+
+// tryFlock is a no-op on platforms without flock(2), only the in-process
+// lock applies there
+func tryFlock(f *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
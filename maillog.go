@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Mail log ingestion: Postfix's delivery log lines are attributed to the
+// aliases they were addressed to (the orig_to of the delivery), so the
+// report can show forwarding targets that bounce or are deferred, and
+// aliases that receive no mail. Statistics are kept in memory and rebuilt
+// from the current log file at startup.
+
+// TargetStats counts the delivery attempts of an alias to one of its targets
+type TargetStats struct {
+	Target     string    `json:"target"`
+	Sent       int64     `json:"sent"`
+	Deferred   int64     `json:"deferred"`
+	Bounced    int64     `json:"bounced"`
+	LastStatus string    `json:"last_status"`
+	LastTime   time.Time `json:"last_time"`
+	// the reason of the last failed attempt
+	LastError string `json:"last_error,omitempty"`
+}
+
+// AliasUsage is the delivery statistics of an alias
+type AliasUsage struct {
+	Alias        string         `json:"alias"`
+	Target       string         `json:"target"`
+	Sent         int64          `json:"sent"`
+	Deferred     int64          `json:"deferred"`
+	Bounced      int64          `json:"bounced"`
+	LastDelivery time.Time      `json:"last_delivery"`
+	Targets      []*TargetStats `json:"targets,omitempty"`
+}
+
+// UsageReport is the report of a domain's alias usage since the statistics
+// were started
+type UsageReport struct {
+	Since       time.Time      `json:"since"`
+	DeadTargets []*TargetStats `json:"dead_targets"`
+	Unused      []Alias        `json:"unused"`
+	Aliases     []AliasUsage   `json:"aliases"`
+}
+
+// deliveries of a message still deferred, by target, to count as bounced
+// if the message expires
+type queuedMessage struct {
+	deferred map[string]string
+}
+
+// limit on the messages tracked, in case their removal was not logged
+const maxQueuedMessages = 100000
+
+var mail_usage = struct {
+	sync.Mutex
+	enabled bool
+	since   time.Time
+	// by folded alias, then by folded target
+	aliases map[string]map[string]*TargetStats
+	queue   map[string]*queuedMessage
+}{
+	aliases: make(map[string]map[string]*TargetStats),
+	queue:   make(map[string]*queuedMessage),
+}
+
+var (
+	// timestamp, host, process, queue ID and message, with traditional
+	// syslog or RFC 3339 timestamps
+	mailLogLine = regexp.MustCompile(`^([A-Z][a-z]{2} +\d+ \d\d:\d\d:\d\d|\d{4}-\d\d-\d\dT\S+) \S+ \S*postfix\S*/(\w+)\[\d+\]: ([0-9A-Za-z]{5,}): (.*)$`)
+	toField     = regexp.MustCompile(`(?:^|, )to=<([^>]*)>`)
+	origToField = regexp.MustCompile(`, orig_to=<([^>]*)>`)
+	statusField = regexp.MustCompile(`, status=(\w+)(?: \((.*)\))?$`)
+)
+
+// parseLogTime parses a log timestamp, guessing the year of syslog ones
+func parseLogTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t.UTC()
+	}
+	t, err = time.ParseInLocation("Jan _2 15:04:05", strings.Join(strings.Fields(s), " "), time.Local)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	now := time.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t.UTC()
+}
+
+// aliasOf returns the alias a recipient was delivered through, that is the
+// recipient itself or the catch-all alias of its domain, if they are in a
+// configured domain's map
+func aliasOf(recipient string) string {
+	recipient = strings.ToLower(recipient)
+	name := keyDomain(recipient)
+	for _, d := range conf.Domains {
+		if strings.ToLower(d.Name) != name {
+			continue
+		}
+		map_files := []string{d.MapFile}
+		if _, ok := lookupKey("virtual", recipient, map_files); ok {
+			return recipient
+		}
+		if _, ok := lookupKey("virtual", "@"+name, map_files); ok {
+			return "@" + name
+		}
+	}
+	return ""
+}
+
+func recordDelivery(alias string, target string, status string, reason string, t time.Time) {
+	targets := mail_usage.aliases[alias]
+	if targets == nil {
+		targets = make(map[string]*TargetStats)
+		mail_usage.aliases[alias] = targets
+	}
+	stats := targets[strings.ToLower(target)]
+	if stats == nil {
+		stats = &TargetStats{Target: target}
+		targets[strings.ToLower(target)] = stats
+	}
+	switch status {
+	case "sent":
+		stats.Sent++
+	case "deferred":
+		stats.Deferred++
+	default:
+		stats.Bounced++
+	}
+	if status != "sent" {
+		stats.LastError = reason
+	}
+	stats.LastStatus = status
+	stats.LastTime = t
+}
+
+// parseMailLogLine updates the statistics with a Postfix log line, other
+// lines are ignored
+func parseMailLogLine(line string) {
+	m := mailLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	t, service, queue_id, msg := parseLogTime(m[1]), m[2], m[3], m[4]
+	mail_usage.Lock()
+	defer mail_usage.Unlock()
+	if mail_usage.since.IsZero() {
+		mail_usage.since = t
+	}
+	switch service {
+	case "cleanup":
+		// a new message enters the queue
+		if strings.HasPrefix(msg, "message-id=") && len(mail_usage.queue) < maxQueuedMessages {
+			mail_usage.queue[queue_id] = &queuedMessage{make(map[string]string)}
+		}
+	case "qmgr":
+		queued := mail_usage.queue[queue_id]
+		switch {
+		case msg == "removed":
+			delete(mail_usage.queue, queue_id)
+		case strings.Contains(msg, "status=expired") && queued != nil:
+			// deliveries still deferred when the message expires bounce
+			for target, alias := range queued.deferred {
+				recordDelivery(alias, target, "expired", "message expired in the queue", t)
+			}
+			queued.deferred = make(map[string]string)
+		}
+	default:
+		// delivery agents: smtp, lmtp, local, virtual, pipe...
+		to := toField.FindStringSubmatch(msg)
+		status := statusField.FindStringSubmatch(msg)
+		if to == nil || status == nil {
+			return
+		}
+		recipient := to[1]
+		if orig_to := origToField.FindStringSubmatch(msg); orig_to != nil {
+			recipient = orig_to[1]
+		}
+		alias := aliasOf(recipient)
+		if alias == "" {
+			return
+		}
+		recordDelivery(alias, to[1], status[1], status[2], t)
+		if queued := mail_usage.queue[queue_id]; queued != nil {
+			if status[1] == "deferred" {
+				queued.deferred[to[1]] = alias
+			} else {
+				delete(queued.deferred, to[1])
+			}
+		}
+	}
+}
+
+// readMailLog parses log lines until the end of the input
+func readMailLog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		parseMailLogLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// tailMailLog parses a log file from the start, then follows it as it is
+// appended to, reopening it when it is rotated
+func tailMailLog(file_name string) {
+	var f *os.File
+	var r *bufio.Reader
+	var partial string
+	reported := false
+	for {
+		if f == nil {
+			var err error
+			f, err = os.Open(file_name)
+			if err != nil {
+				if !reported {
+					log.Println("could not open mail log", file_name, "due to", err)
+					reported = true
+				}
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			reported = false
+			r = bufio.NewReader(f)
+			partial = ""
+		}
+		line, err := r.ReadString('\n')
+		partial += line
+		if err == nil {
+			parseMailLogLine(strings.TrimSuffix(partial, "\n"))
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			log.Println("could not read mail log", file_name, "due to", err)
+			f.Close()
+			f = nil
+			continue
+		}
+		// wait for more lines, or for the log to be rotated
+		time.Sleep(time.Second)
+		info, err := os.Stat(file_name)
+		current, cerr := f.Stat()
+		offset, serr := f.Seek(0, io.SeekCurrent)
+		if err == nil && cerr == nil && serr == nil && (!os.SameFile(info, current) || info.Size() < offset) {
+			f.Close()
+			f = nil
+		}
+	}
+}
+
+// startMailLog follows the Postfix log file, or reads the log from
+// standard input if file_name is -
+func startMailLog(file_name string, domains []Domain) {
+	if file_name == "" {
+		return
+	}
+	startIndex(domains)
+	mail_usage.Lock()
+	mail_usage.enabled = true
+	mail_usage.Unlock()
+	if file_name == "-" {
+		go func() {
+			err := readMailLog(os.Stdin)
+			log.Println("mail log input closed", err)
+		}()
+		return
+	}
+	go tailMailLog(file_name)
+}
+
+// usageReport summarizes the usage of the domain's aliases
+//
+// The caller must hold the map lock, see lockMap.
+func usageReport(domain Domain) (UsageReport, error) {
+	aliases, err := domainAliases(domain)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	mail_usage.Lock()
+	defer mail_usage.Unlock()
+	report := UsageReport{
+		Since:       mail_usage.since,
+		DeadTargets: make([]*TargetStats, 0),
+		Unused:      make([]Alias, 0),
+		Aliases:     make([]AliasUsage, 0, len(aliases)),
+	}
+	for _, a := range aliases {
+		if is_spam(a.Target) {
+			continue
+		}
+		usage := AliasUsage{Alias: a.Email, Target: a.Target}
+		for _, stats := range mail_usage.aliases[strings.ToLower(a.Email)] {
+			// report a copy, as the statistics keep being updated
+			s := *stats
+			usage.Targets = append(usage.Targets, &s)
+			usage.Sent += s.Sent
+			usage.Deferred += s.Deferred
+			usage.Bounced += s.Bounced
+			if s.Sent > 0 && s.LastStatus == "sent" && s.LastTime.After(usage.LastDelivery) {
+				usage.LastDelivery = s.LastTime
+			}
+			if s.LastStatus != "sent" {
+				report.DeadTargets = append(report.DeadTargets, &s)
+			}
+		}
+		sort.Slice(usage.Targets, func(i, j int) bool { return usage.Targets[i].Target < usage.Targets[j].Target })
+		if usage.Sent == 0 {
+			report.Unused = append(report.Unused, a)
+		}
+		report.Aliases = append(report.Aliases, usage)
+	}
+	sort.Slice(report.DeadTargets, func(i, j int) bool {
+		return report.DeadTargets[i].LastTime.After(report.DeadTargets[j].LastTime)
+	})
+	return report, nil
+}
+
+// lockedUsageReport returns the report of the request's domain, and whether
+// the mail log is being read at all
+func lockedUsageReport(c echo.Context) (UsageReport, bool, error) {
+	domain := c.Get("domain").(Domain)
+	mail_usage.Lock()
+	enabled := mail_usage.enabled
+	mail_usage.Unlock()
+	if !enabled {
+		return UsageReport{}, false, nil
+	}
+	unlock, err := lockMap(domain, false)
+	if err != nil {
+		return UsageReport{}, true, err
+	}
+	defer unlock()
+	report, err := usageReport(domain)
+	return report, true, err
+}
+
+func Report(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	report, enabled, err := lockedUsageReport(c)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "report", struct {
+		Domain  string
+		Enabled bool
+		Report  UsageReport
+	}{domain.Name, enabled, report})
+}
+
+func APIReport(c echo.Context) error {
+	report, enabled, err := lockedUsageReport(c)
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, err.Error())
+	}
+	if !enabled {
+		return apiError(c, http.StatusNotFound, "the mail log is not being read")
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/base64"
 	"net/http"
-
-	"golang.org/x/crypto/bcrypt"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
@@ -22,23 +22,37 @@ func BasicAuth(next echo.HandlerFunc) echo.HandlerFunc {
 		auth := c.Request().Header.Get(echo.HeaderAuthorization)
 		l := len(Basic)
 
+		if strings.HasPrefix(auth, Bearer+" ") {
+			return tokenAuth(c, next, strings.TrimSpace(auth[len(Bearer)+1:]))
+		}
 		if len(auth) > l+1 && auth[:l] == Basic {
 			b, err := base64.StdEncoding.DecodeString(auth[l+1:])
 			if err == nil {
 				cred := string(b)
 				for i := 0; i < len(cred); i++ {
 					if cred[i] == ':' {
+						if wait := authLocked(c, cred[:i]); wait > 0 {
+							c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+							return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed logins, try again later")
+						}
 						// Verify credentials
-						for _, d := range conf.Domains {
-							if cred[:i] == d.Name && bcrypt.CompareHashAndPassword([]byte(d.PassHash), []byte(cred[i+1:])) == nil {
-								c.Set("domain", d)
-								err := next(c)
-								if err != nil {
-									c.Error(err)
-								}
-								return err
+						user, err := checkCredentials(cred[:i], cred[i+1:])
+						if err == nil {
+							authSucceeded(c, cred[:i])
+							c.Set("user", user)
+							err := next(c)
+							if err != nil {
+								c.Error(err)
 							}
+							return err
+						}
+						// the browser asks again for an expired
+						// login, which is not a failed one
+						if err != ErrReusedCode {
+							authFailed(c, cred[:i])
+							auditAuthFailure(c, cred[:i])
 						}
+						break
 					}
 				}
 			}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Postfix SMTP access policy delegation server, see:
+// http://www.postfix.org/SMTPD_POLICY_README.html
+// It never rejects anything, but counts the recipients of each alias and
+// spam entry, so the spreadsheet can show which aliases actually receive
+// mail and which blocked ones are still targeted. Counts are kept in
+// <map file>.hits and saved periodically.
+
+const hitsSaveInterval = time.Minute
+
+// Hits is how often an alias was a recipient, and when it last was
+type Hits struct {
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+var alias_hits = struct {
+	sync.Mutex
+	enabled bool
+	// by map file, then by folded alias
+	hits  map[string]map[string]*Hits
+	dirty map[string]bool
+}{hits: make(map[string]map[string]*Hits), dirty: make(map[string]bool)}
+
+func hitsFile(map_file string) string {
+	return map_file + ".hits"
+}
+
+// loadHits reads the saved counts of the domains' map files
+func loadHits(domains []Domain) {
+	alias_hits.Lock()
+	defer alias_hits.Unlock()
+	alias_hits.enabled = true
+	for _, d := range domains {
+		if _, ok := alias_hits.hits[d.MapFile]; ok {
+			continue
+		}
+		hits := make(map[string]*Hits)
+		data, err := os.ReadFile(hitsFile(d.MapFile))
+		if err == nil {
+			err = json.Unmarshal(data, &hits)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("could not load alias hits from", hitsFile(d.MapFile), "due to", err)
+		}
+		alias_hits.hits[d.MapFile] = hits
+	}
+}
+
+// saveHits writes the counts that changed since they were last saved
+func saveHits() {
+	alias_hits.Lock()
+	defer alias_hits.Unlock()
+	for map_file := range alias_hits.dirty {
+		data, err := json.MarshalIndent(alias_hits.hits[map_file], "", "  ")
+		if err == nil {
+			tmp := hitsFile(map_file) + ".new"
+			err = os.WriteFile(tmp, data, 0644)
+			if err == nil {
+				err = os.Rename(tmp, hitsFile(map_file))
+			}
+		}
+		if err != nil {
+			log.Println("could not save alias hits to", hitsFile(map_file), "due to", err)
+			continue
+		}
+		delete(alias_hits.dirty, map_file)
+	}
+}
+
+// domainHits returns the counts of the domain's aliases, keyed by folded
+// alias, or nil if they are not being counted
+func domainHits(domain Domain) map[string]Hits {
+	alias_hits.Lock()
+	defer alias_hits.Unlock()
+	if !alias_hits.enabled {
+		return nil
+	}
+	hits := make(map[string]Hits)
+	for alias, h := range alias_hits.hits[domain.MapFile] {
+		if keyDomain(alias) == strings.ToLower(domain.Name) {
+			hits[alias] = *h
+		}
+	}
+	return hits
+}
+
+// recordHit counts a recipient against the spam entry or alias it matches,
+// including catch-all @domain aliases
+func recordHit(recipient string) {
+	recipient = strings.ToLower(recipient)
+	name := keyDomain(recipient)
+	var map_file string
+	for _, d := range conf.Domains {
+		if strings.ToLower(d.Name) == name {
+			map_file = d.MapFile
+			break
+		}
+	}
+	if map_file == "" {
+		return
+	}
+	map_files := []string{map_file}
+	key := ""
+	if _, ok := lookupKey("access", recipient, map_files); ok {
+		key = recipient
+	} else if _, ok := lookupKey("virtual", recipient, map_files); ok {
+		key = recipient
+	} else if _, ok := lookupKey("virtual", "@"+name, map_files); ok {
+		key = "@" + name
+	} else {
+		return
+	}
+	alias_hits.Lock()
+	defer alias_hits.Unlock()
+	hits := alias_hits.hits[map_file]
+	if hits == nil {
+		hits = make(map[string]*Hits)
+		alias_hits.hits[map_file] = hits
+	}
+	h := hits[key]
+	if h == nil {
+		h = &Hits{}
+		hits[key] = h
+	}
+	h.Count++
+	h.LastSeen = time.Now().UTC()
+	alias_hits.dirty[map_file] = true
+}
+
+// servePolicy reads policy requests, a list of name=value attributes ended
+// by an empty line, and lets them through
+func servePolicy(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, socketmapMaxRequest)
+	attrs := make(map[string]string)
+	oversized := false
+	for {
+		conn.SetDeadline(time.Now().Add(socketmapIdle))
+		slice, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// drop attributes too long to be of interest, up to their end
+			oversized = true
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if oversized {
+			oversized = false
+			continue
+		}
+		line := strings.TrimRight(string(slice), "\r\n")
+		if line != "" {
+			name, value, _ := strings.Cut(line, "=")
+			attrs[name] = value
+			if len(attrs) > 100 {
+				log.Println("policy request too large, closing connection")
+				return
+			}
+			continue
+		}
+		if attrs["protocol_state"] == "RCPT" && attrs["recipient"] != "" {
+			recordHit(attrs["recipient"])
+		}
+		if *verbose {
+			log.Println("policy request for", strconv.Quote(attrs["recipient"]), "from", attrs["client_address"])
+		}
+		_, err = conn.Write([]byte("action=DUNNO\n\n"))
+		if err != nil {
+			return
+		}
+		attrs = make(map[string]string)
+	}
+}
+
+// startPolicyService serves policy delegation requests on a unix socket if
+// address is an absolute path, or TCP otherwise
+func startPolicyService(address string, domains []Domain) {
+	if address == "" {
+		return
+	}
+	startIndex(domains)
+	loadHits(domains)
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+		// remove the socket left behind by a previous run
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal("could not listen for policy requests on ", address, " due to ", err)
+	}
+	if network == "unix" {
+		// the Postfix daemons must be able to connect
+		err = os.Chmod(address, 0660)
+		if err != nil {
+			log.Fatal("could not set permissions of policy socket ", address, " due to ", err)
+		}
+	}
+	log.Println("serving policy requests on", address)
+	go func() {
+		for range time.Tick(hitsSaveInterval) {
+			saveHits()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println("could not accept policy connection due to", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go servePolicy(conn)
+		}
+	}()
+}
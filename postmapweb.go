@@ -13,11 +13,10 @@ import (
 	"net/http"
 	"net/mail"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 
 	"golang.org/x/crypto/bcrypt"
@@ -32,14 +31,59 @@ type Domain struct {
 	MapFile  string
 	PassHash string
 	Script   string
+	// Postfix lookup table type of the map, hash by default, see backend.go
+	MapType string `json:",omitempty"`
+	// two-factor authentication of the domain login, see totp.go
+	TOTPSecret    string   `json:",omitempty"`
+	RecoveryCodes []string `json:",omitempty"`
 }
 type Config struct {
 	Domains []Domain
+	// users and the roles they have on domains, see users.go
+	Users []User
+	// tokens of the JSON API, see tokens.go
+	Tokens []APIToken `json:",omitempty"`
+	// history of map file versions, by default in <map file>.history
+	HistoryDir     string
+	HistoryKeep    int
+	HistoryMaxDays int
+	// JSON lines audit log, disabled if empty
+	AuditLog string
+	// how long to wait for other processes locking the map files, in seconds
+	LockTimeout int
+	// post-processing: seconds to batch reloads for, script hook timeout in
+	// seconds and number of retries of failed steps
+	ReloadWindow int
+	HookTimeout  int
+	JobRetries   int
+	// unix socket (if an absolute path) or host:port to serve the policy
+	// delegation protocol on, disabled if empty
+	PolicyService string
+	// Postfix log file to follow for alias usage reports, or - to read the
+	// log from standard input, disabled if empty
+	MailLog string
+	// unix socket to serve socketmap lookups on, disabled if empty
+	SocketMap string
+	// log in with a form and session cookies instead of HTTP basic
+	// authentication, see session.go
+	SessionLogin       bool
+	SessionIdleMinutes int
+	SessionMaxHours    int
+	// failed logins before a lockout, its initial length in seconds, and
+	// the file saving them, <config file>.lockouts by default, see
+	// throttle.go
+	AuthMaxFailures    int
+	AuthLockoutSeconds int
+	LockoutFile        string
+	// header with the user name set by an authenticating reverse proxy,
+	// and the addresses of the proxies allowed to set it, see proxyauth.go
+	ProxyAuthHeader string   `json:",omitempty"`
+	TrustedProxies  []string `json:",omitempty"`
 }
 
 var conf Config
 
-//go:embed templates/view.html templates/view.js templates/error.html
+//go:embed templates/view.html templates/view.js templates/error.html templates/preview.html templates/history.html templates/revision.html templates/audit.html templates/report.html templates/dashboard.html templates/login.html
 var assets embed.FS
 
 //go:embed handsontable static
@@ -47,30 +91,77 @@ var staticAssets embed.FS
 
 func View(c echo.Context) error {
 	domain := c.Get("domain").(Domain)
+	scope := ""
+	if s := requestScope(c); !s.whole() {
+		scope = s.String()
+	}
 	return c.Render(http.StatusOK, "view", struct {
-		Domain string
-	}{domain.Name})
+		Domain     string
+		Domains    []string
+		Job        string
+		ReadOnly   bool
+		Scope      string
+		Viewer     bool
+		Admin      bool
+		SuperAdmin bool
+		User       string
+		Session    bool
+		CSRF       string
+	}{
+		domain.Name,
+		userDomains(c.Get("user").(User)),
+		c.QueryParam("job"),
+		!canChange(c),
+		scope,
+		hasRole(c, RoleViewer) && scope == "",
+		hasRole(c, RoleAdmin),
+		isSuperAdmin(c.Get("user").(User)),
+		principal(c),
+		c.Get("session") != nil,
+		csrfToken(c),
+	})
 }
 
 func JS(c echo.Context) error {
 	domain := c.Get("domain").(Domain)
-	a := readMapFile(domain.MapFile, nil)
+	unlock, err := lockMap(domain, false)
+	if err != nil {
+		return err
+	}
+	a, version, err := currentAliases(domain)
+	unlock()
+	if err != nil {
+		return err
+	}
+	a = requestScope(c).filter(a)
+	// recipient counts from the policy service, if enabled
+	hits := domainHits(domain)
 	b := make([][]string, 0)
 	for i := 0; i < len(a); i++ {
-		if strings.Contains(a[i].Email, "@"+domain.Name) {
-			b = append(b, []string{a[i].Email, a[i].Target})
+		row := []string{a[i].Email, a[i].Target}
+		if hits != nil {
+			h, ok := hits[strings.ToLower(a[i].Email)]
+			if ok {
+				row = append(row, strconv.FormatInt(h.Count, 10), h.LastSeen.Local().Format("2006-01-02 15:04"))
+			} else {
+				row = append(row, "0", "never")
+			}
 		}
+		b = append(b, row)
 	}
-	if len(b) == 0 {
+	if len(b) == 0 && requestScope(c).whole() {
 		b = append(b, []string{"@" + domain.Name, "nobody"})
 	}
 
 	tmpl := c.Echo().Renderer.(Renderer).Template("js")
 	var w bytes.Buffer
-	err := tmpl.Execute(&w, struct {
-		Aliases [][]string
-		Domain  string
-	}{b, domain.Name})
+	err = tmpl.Execute(&w, struct {
+		Aliases  [][]string
+		Domain   string
+		Version  string
+		Hits     bool
+		ReadOnly bool
+	}{b, domain.Name, version, hits != nil, !canChange(c)})
 	if err != nil {
 		return err
 	}
@@ -84,9 +175,38 @@ func JS(c echo.Context) error {
 }
 
 type ChangeRequest struct {
-	Op     string
-	Alias  string
-	Target string
+	Op     string `json:"op"`
+	Alias  string `json:"alias"`
+	Target string `json:"target,omitempty"`
+}
+
+// ChangeResult is the outcome of a single ChangeRequest after normalization
+// and validation, Error is set if the change was rejected
+type ChangeResult struct {
+	Op       string `json:"op"`
+	Alias    string `json:"alias"`
+	Previous string `json:"previous,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var ErrInvalidChanges = errors.New("invalid changes")
+
+// ErrorPage is the data for the error template
+type ErrorPage struct {
+	Error   string
+	Details []string
+}
+
+// PreviewPage is the data for the preview template
+type PreviewPage struct {
+	Domain  string
+	Changes string
+	Version string
+	Results []ChangeResult
+	Map     []DiffLine
+	Spam    []DiffLine
+	CSRF    string
 }
 
 func new_line(label string, fw *bufio.Writer, email string, dest string) {
@@ -126,43 +246,50 @@ func validate(target string, local map[string]bool) bool {
 	return true
 }
 
-var rewrite_lock sync.Mutex
-
 func is_spam(e string) bool {
 	return e == "spam" || e == "SPAM" || strings.HasPrefix(e, "550 ")
 }
 
-func Change(c echo.Context) error {
-	var changes []ChangeRequest
-	domain := c.Get("domain").(Domain)
+// inDomain tells whether an alias, an address or a catch-all @domain, is in
+// the domain itself, and not e.g. in example.com.au for example.com
+func inDomain(email string, domain Domain) bool {
+	return strings.ContainsRune(email, '@') && keyDomain(email) == strings.ToLower(domain.Name)
+}
 
-	if c.FormValue("changes") == "" && c.FormValue("user") != "" && c.FormValue("dest") != "" {
-		// quick entry form
-		changes = []ChangeRequest{
-			{
-				"add",
-				strings.TrimSpace(c.FormValue("user")) + "@" + domain.Name,
-				strings.TrimSpace(c.FormValue("dest")),
-			},
-		}
-	} else {
-		err := json.Unmarshal([]byte(c.FormValue("changes")), &changes)
-		if err != nil {
-			return err
+// domainAliases returns the entries of the domain's map files that belong
+// to the domain itself
+func domainAliases(domain Domain) ([]Alias, error) {
+	a, err := readMapFile(domain, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]Alias, 0)
+	for i := 0; i < len(a); i++ {
+		if inDomain(a[i].Email, domain) {
+			b = append(b, a[i])
 		}
 	}
-	log.Println("Received changes", changes)
+	return b, nil
+}
 
-	// serialize map file rewrites
-	rewrite_lock.Lock()
-	defer func() {
-		rewrite_lock.Unlock()
-	}()
+// prepareChanges dedupes and normalizes changes against the current map
+// file, returning the rewrite table for commitChanges and one result per
+// change. If any change is invalid, it returns ErrInvalidChanges and the
+// offending results have their Error set. Changes to aliases outside the
+// user's scope are invalid.
+//
+// The caller must hold the map lock, see lockMap.
+func prepareChanges(domain Domain, changes []ChangeRequest, scope aliasScope) (map[string]string, []ChangeResult, error) {
 	// find all existing local addresses, but exclude command delivery
-	a := readMapFile(domain.MapFile, nil)
+	a, err := readMapFile(domain, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 	local := make(map[string]bool)
+	previous := make(map[string]string)
 	for i := 0; i < len(a); i++ {
-		if strings.Contains(a[i].Email, "@"+domain.Name) && !strings.ContainsAny(a[i].Target, "@|") {
+		previous[a[i].Email] = a[i].Target
+		if inDomain(a[i].Email, domain) && !strings.ContainsAny(a[i].Target, "@|") {
 			for _, dest := range strings.Split(a[i].Target, ",") {
 				local[strings.TrimSpace(dest)] = true
 			}
@@ -170,48 +297,79 @@ func Change(c echo.Context) error {
 	}
 	// dedupe and normalize changes
 	remap := make(map[string]string)
+	results := make([]ChangeResult, 0, len(changes))
+	invalid := false
 	for _, change := range changes {
+		result := ChangeResult{Op: change.Op, Alias: change.Alias, Target: change.Target}
 		address, err := mail.ParseAddress(change.Alias)
 		if err != nil || !strings.HasSuffix(address.Address, "@"+domain.Name) {
 			if change.Alias == "@"+domain.Name {
 				address = &mail.Address{Address: change.Alias}
 			} else {
 				log.Println("invalid alias:", change.Alias)
-				return c.Render(http.StatusBadRequest, "error", struct {
-					Error string
-				}{"invalid alias: " + change.Alias})
+				result.Error = "invalid alias: " + change.Alias
+				results = append(results, result)
+				invalid = true
+				continue
 			}
 		}
+		result.Alias = address.Address
+		result.Previous = previous[address.Address]
+		_, exists := previous[address.Address]
+		if !scope.allows(ChangeRequest{change.Op, address.Address, change.Target}, result.Previous, exists) {
+			result.Error = "you can only change " + scope.String() + ", not " + address.Address
+			if scope.owner != "" && exists && scope.owns(Alias{address.Address, result.Previous}) {
+				result.Error = "you can only take your own address out of " + address.Address
+			}
+			results = append(results, result)
+			invalid = true
+			continue
+		}
 		switch change.Op {
 		case "remove":
 			remap[address.Address] = ""
+			result.Target = ""
 		case "add":
 			if validate(change.Target, local) {
 				remap[address.Address] = change.Target
 			} else {
-				return c.Render(http.StatusBadRequest, "error", struct {
-					Error string
-				}{"invalid email address list for " + address.Address + ": " + change.Target})
+				result.Error = "invalid email address list for " + address.Address + ": " + change.Target
+				invalid = true
 			}
 		default:
-			log.Fatal("unexpected change request: ", change)
+			log.Println("unexpected change request:", change)
+			result.Error = "unexpected operation " + change.Op + " for " + address.Address
+			invalid = true
 		}
+		results = append(results, result)
 	}
-	// rewrite the map file atomically
-	tmp_file := domain.MapFile + ".web.new"
-	f, err := os.OpenFile(tmp_file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Fatal("could not rewrite map file ", tmp_file, " due to ", err)
+	if invalid {
+		return nil, results, ErrInvalidChanges
 	}
-	fw := bufio.NewWriter(f)
-	// recipient of "spam" goes to its own file
-	spam, err := os.OpenFile(tmp_file+".spam", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Fatal("could not rewrite spam map file ", tmp_file+".spam", " due to ", err)
+	return remap, results, nil
+}
+
+// firstError returns the first validation error in results
+func firstError(results []ChangeResult) string {
+	for _, result := range results {
+		if result.Error != "" {
+			return result.Error
+		}
+	}
+	return ""
+}
+
+// rewriteMapFile applies remap to the domain's map files, writing the new
+// main map to fw and the new spam map to sw
+func rewriteMapFile(domain Domain, remap map[string]string, fw *bufio.Writer, sw *bufio.Writer) error {
+	// work on a copy, as entries are consumed as they are written
+	pending := make(map[string]string, len(remap))
+	for email, dest := range remap {
+		pending[email] = dest
 	}
-	sw := bufio.NewWriter(spam)
+	remap = pending
 	//log.Println("Preparing to rewrite map files")
-	readMapFile(domain.MapFile, func(line string, email string) {
+	_, err := readMapFile(domain, func(line string, email string) {
 		//log.Printf("RLMF \"%s\" \"%s\" \"%s\"\n", line, email, remap[email])
 		if email == "" {
 			fw.WriteString(line + "\n")
@@ -243,6 +401,9 @@ func Change(c echo.Context) error {
 			}
 		}
 	})
+	if err != nil {
+		return err
+	}
 	for email, dest := range remap {
 		if dest != "" {
 			if is_spam(dest) {
@@ -255,72 +416,161 @@ func Change(c echo.Context) error {
 			}
 		}
 	}
-	fw.Flush()
-	sw.Flush()
-	f.Close()
-	spam.Close()
-	err = os.Rename(domain.MapFile, domain.MapFile+".old")
+	err = fw.Flush()
 	if err != nil {
 		return err
 	}
+	return sw.Flush()
+}
 
-	err = os.Rename(domain.MapFile+".spam", domain.MapFile+".spam.old")
+// Preview is the result of a dry run of a set of changes
+type Preview struct {
+	MapDiff  string `json:"map_diff"`
+	SpamDiff string `json:"spam_diff"`
+}
+
+// renderChanges returns the new contents of the domain's map and spam map
+// files after applying remap
+func renderChanges(domain Domain, remap map[string]string) ([]byte, []byte, error) {
+	var map_buf, spam_buf bytes.Buffer
+	fw := bufio.NewWriter(&map_buf)
+	sw := bufio.NewWriter(&spam_buf)
+	err := rewriteMapFile(domain, remap, fw, sw)
+	return map_buf.Bytes(), spam_buf.Bytes(), err
+}
 
-	err = os.Rename(tmp_file, domain.MapFile)
+// previewChanges performs the same rewrite as commitChanges, but in memory,
+// and returns the differences with the current map files. Only the domain's
+// own entries are compared, so the context lines of the diffs do not show
+// other domains sharing the map file.
+//
+// The caller must hold the map lock, see lockMap.
+func previewChanges(domain Domain, remap map[string]string) (Preview, error) {
+	map_data, spam_data, err := renderChanges(domain, remap)
 	if err != nil {
-		os.Rename(domain.MapFile+".old", domain.MapFile)
-		return err
+		return Preview{}, err
 	}
-	err = os.Rename(tmp_file+".spam", domain.MapFile+".spam")
+	map_data, spam_data, err = domainEntries(domain, map_data, spam_data)
 	if err != nil {
-		os.Rename(domain.MapFile+".spam.old", domain.MapFile+".spam")
-		return err
+		return Preview{}, err
 	}
-
-	cmd := exec.Command("postmap", domain.MapFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	old_map, old_spam, err := loadMaps(domain)
 	if err != nil {
-		log.Println("error running postmap on map file:", err)
-		os.Rename(domain.MapFile, domain.MapFile+".bad")
-		os.Rename(domain.MapFile+".old", domain.MapFile)
-		return err
+		return Preview{}, err
 	}
-
-	cmd = exec.Command("postmap", domain.MapFile+".spam")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	old_map, old_spam, err = domainEntries(domain, old_map, old_spam)
 	if err != nil {
-		log.Println("error running postmap on spam file:", err)
-		os.Rename(domain.MapFile+".spam", domain.MapFile+".spam.bad")
-		os.Rename(domain.MapFile+".spam.old", domain.MapFile+".spam")
+		return Preview{}, err
 	}
+	return Preview{
+		unifiedDiff(domain.MapFile, string(old_map), string(map_data)),
+		unifiedDiff(domain.MapFile+".spam", string(old_spam), string(spam_data)),
+	}, nil
+}
 
-	cmd = exec.Command("postfix", "reload")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+// commitChanges rewrites the domain's map and spam map files according to
+// remap and installs them.
+//
+// The caller must hold the map lock, see lockMap.
+func commitChanges(domain Domain, remap map[string]string) ([]Step, error) {
+	map_data, spam_data, err := renderChanges(domain, remap)
 	if err != nil {
-		log.Println("postfix reload failed:", err)
+		return nil, &StageError{"prepare", err}
+	}
+	return installMaps(domain, map_data, spam_data)
+}
+
+func Change(c echo.Context) error {
+	var changes []ChangeRequest
+	domain := c.Get("domain").(Domain)
+
+	if c.FormValue("changes") == "" && c.FormValue("user") != "" && c.FormValue("dest") != "" {
+		// quick entry form
+		changes = []ChangeRequest{
+			{
+				"add",
+				strings.TrimSpace(c.FormValue("user")) + "@" + domain.Name,
+				strings.TrimSpace(c.FormValue("dest")),
+			},
+		}
+	} else {
+		err := json.Unmarshal([]byte(c.FormValue("changes")), &changes)
+		if err != nil {
+			return err
+		}
 	}
+	log.Println("Received changes", changes)
 
-	// optional script hook
-	if domain.Script != "" {
-		cmd = exec.Command(domain.Script, domain.Name)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	// serialize map file rewrites
+	unlock, err := lockMap(domain, true)
+	if err == ErrMapBusy {
+		c.Response().Header().Set(echo.HeaderRetryAfter, "5")
+		return c.Render(http.StatusServiceUnavailable, "error", ErrorPage{err.Error(), nil})
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conflicts, err := checkVersion(domain, c.FormValue("version"), requestScope(c))
+	switch err {
+	case nil:
+	case ErrMissingVersion:
+		return c.Render(http.StatusPreconditionRequired, "error", ErrorPage{err.Error(), nil})
+	case ErrStaleVersion:
+		log.Println("rejected stale changes for", domain.Name, conflicts)
+		audit(c, "change", nil, nil, err)
+		return c.Render(http.StatusConflict, "error", ErrorPage{err.Error(), conflicts})
+	default:
+		return err
+	}
+	remap, results, err := prepareChanges(domain, changes, requestScope(c))
+	if err == ErrInvalidChanges {
+		audit(c, "change", results, nil, err)
+		return c.Render(http.StatusBadRequest, "error", ErrorPage{firstError(results), nil})
+	}
+	if err != nil {
+		return err
+	}
+	if c.FormValue("preview") != "" {
+		// dry run, show what would change and ask for confirmation
+		preview, err := previewChanges(domain, remap)
 		if err != nil {
-			log.Println("script", domain.Script, "failed:", err)
+			return err
+		}
+		if !requestScope(c).whole() {
+			// the context of the diffs would show other aliases
+			preview = Preview{}
+		}
+		changes_json, err := json.Marshal(changes)
+		if err != nil {
+			return err
 		}
+		return c.Render(http.StatusOK, "preview", PreviewPage{
+			domain.Name,
+			string(changes_json),
+			c.FormValue("version"),
+			results,
+			diffRows(preview.MapDiff),
+			diffRows(preview.SpamDiff),
+			csrfToken(c),
+		})
+	}
+	steps, err := commitChanges(domain, remap)
+	audit(c, "change", results, steps, err)
+	if err != nil {
+		log.Println("could not commit changes for", domain.Name, "due to", err)
+		return c.Render(http.StatusInternalServerError, "error", ErrorPage{
+			"Your changes could not be applied and were rolled back: " + err.Error(),
+			nil,
+		})
 	}
+	recordHistory(c, domain, results, "")
+	job := enqueuePostProcessing(c, domain)
 
 	// HTTP 303 is specifically for POST/Redirect/GET
 	// see: https://en.wikipedia.org/wiki/Post/Redirect/Get
-	c.Response().Header().Set("Location", "/")
-	return c.HTML(303, "<script>document.location.href = \"/\";</script>")
+	c.Response().Header().Set("Location", "/?job="+job.ID)
+	return c.HTML(303, "<script>document.location.href = \"/?job="+job.ID+"\";</script>")
 }
 
 func readConf(conf_file string) Config {
@@ -344,6 +594,22 @@ func readConf(conf_file string) Config {
 	if err != nil || bytes_read < conf_size {
 		log.Fatal("could not decode conf file ", conf_file, " due to ", err)
 	}
+	for _, d := range conf.Domains {
+		_, err = aliasStore(d)
+		if err != nil {
+			log.Fatal("invalid conf file ", conf_file, ": ", err)
+		}
+	}
+	err = checkUsers(conf)
+	if err == nil {
+		err = checkTokens(conf)
+	}
+	if err == nil {
+		trusted_proxies, err = parseTrustedProxies(conf)
+	}
+	if err != nil {
+		log.Fatal("invalid conf file ", conf_file, ": ", err)
+	}
 	if *verbose {
 		log.Println("config file:", conf)
 	}
@@ -366,8 +632,12 @@ func updateConf(conf Config, conf_file string, domain string, virtual string, pa
 		}
 	}
 	if !existing {
-		conf.Domains = append(conf.Domains, Domain{domain, virtual, string(pass_hash), ""})
+		conf.Domains = append(conf.Domains, Domain{Name: domain, MapFile: virtual, PassHash: string(pass_hash)})
 	}
+	writeConf(conf, conf_file)
+}
+
+func writeConf(conf Config, conf_file string) {
 	conf_json, err := json.MarshalIndent(conf, "", "  ")
 	if err != nil {
 		log.Fatal("Could not marshal the config: ", err)
@@ -387,29 +657,31 @@ func updateConf(conf Config, conf_file string, domain string, virtual string, pa
 }
 
 type Alias struct {
-	Email  string
-	Target string
+	Email  string `json:"alias"`
+	Target string `json:"target"`
 }
 
-func readMapFile(map_file string, hook func(line string, email string)) []Alias {
-	good, err := readSingleMapFile(map_file, hook)
+// readMapFile parses the domain's main and spam maps, calling hook with
+// every line and the alias it defines, if any
+func readMapFile(domain Domain, hook func(line string, email string)) ([]Alias, error) {
+	map_data, spam_data, err := loadMaps(domain)
 	if err != nil {
-		log.Fatal("could not open map file ", map_file, " due to ", err)
+		return nil, err
 	}
-	spam, err := readSingleMapFile(map_file+".spam", hook)
-	if err == nil {
-		good = append(good, spam...)
+	good, err := readSingleMap(map_data, false, hook)
+	if err != nil {
+		return nil, err
 	}
-	return good
-}
-
-func readSingleMapFile(map_file string, hook func(line string, email string)) ([]Alias, error) {
-	f, err := os.Open(map_file)
+	spam, err := readSingleMap(spam_data, true, hook)
 	if err != nil {
 		return nil, err
 	}
+	return append(good, spam...), nil
+}
+
+func readSingleMap(data []byte, is_spam_map bool, hook func(line string, email string)) ([]Alias, error) {
 	aliases := make([]Alias, 0)
-	scanner := bufio.NewScanner(bufio.NewReader(f))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if strings.HasPrefix(line, "#") {
@@ -419,7 +691,7 @@ func readSingleMapFile(map_file string, hook func(line string, email string)) ([
 			continue
 		}
 		fields := strings.Fields(line)
-		if strings.HasSuffix(map_file, ".spam") {
+		if is_spam_map {
 			aliases = append(aliases, Alias{fields[0], strings.Join(fields[1:len(fields)], " ")})
 			if hook != nil {
 				hook(line, fields[0])
@@ -440,7 +712,7 @@ func readSingleMapFile(map_file string, hook func(line string, email string)) ([
 			}
 		}
 	}
-	return aliases, nil
+	return aliases, scanner.Err()
 }
 
 type Renderer struct {
@@ -449,9 +721,16 @@ type Renderer struct {
 
 func (r *Renderer) Load() {
 	r.templates = map[string]*template.Template{
-		"view":  r.parse("view.html", "view"),
-		"js":    r.parse("view.js", "js"),
-		"error": r.parse("error.html", "error"),
+		"view":      r.parse("view.html", "view"),
+		"js":        r.parse("view.js", "js"),
+		"error":     r.parse("error.html", "error"),
+		"preview":   r.parse("preview.html", "preview"),
+		"history":   r.parse("history.html", "history"),
+		"revision":  r.parse("revision.html", "revision"),
+		"audit":     r.parse("audit.html", "audit"),
+		"report":    r.parse("report.html", "report"),
+		"dashboard": r.parse("dashboard.html", "dashboard"),
+		"login":     r.parse("login.html", "login"),
 	}
 }
 func (r Renderer) Template(name string) *template.Template {
@@ -486,16 +765,39 @@ func main() {
 	verbose = flag.Bool("v", false, "verbose logging")
 	domain := flag.String("d", "", "add domain user")
 	virtual := flag.String("m", "/etc/postfix/virtual", "virtual domain map to use with -d")
-	cl_password := flag.String("w", "", "password to use with -d (insecure!)")
+	user := flag.String("u", "", "add or update user")
+	grants := flag.String("g", "", "roles to grant with -u, as domain:role[:pattern][,domain:role...]")
+	cl_password := flag.String("w", "", "password to use with -d or -u (insecure!)")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 	port := flag.String("p", "localhost:8080", "host address and port to bind to")
+	check := flag.Bool("check", false, "check that the compiled map files are up to date and exit")
+	lockouts := flag.Bool("lockouts", false, "list the IPs and users with failed logins and exit")
+	unlock := flag.String("unlock", "", "clear the failed logins of ip:<address>, user:<name> or all and exit")
+	token := flag.String("token", "", "create an API token for a domain and exit")
+	scope := flag.String("scope", ScopeRead, "scope of the token created with -token: read, add or write")
+	token_days := flag.Int("token-days", 0, "days until the token created with -token expires, 0 for never")
+	comment := flag.String("comment", "", "comment of the token created with -token")
+	revoke := flag.String("revoke", "", "revoke the API token with this ID and exit")
+	tokens := flag.Bool("tokens", false, "list the API tokens and exit")
+	totp := flag.String("totp", "", "set up two-factor authentication for a user or domain and exit")
+	no_totp := flag.String("no-totp", "", "turn off two-factor authentication for a user or domain and exit")
+	var tcp_listeners tcpListeners
+	flag.Var(&tcp_listeners, "tcp", "serve tcp_table lookups of a map, as map@host:port[/domain,...] (repeatable)")
 	flag.Parse()
 	conf = readConf(*conf_file)
+	conf_path = *conf_file
+	if conf.LockoutFile == "" {
+		conf.LockoutFile = *conf_file + ".lockouts"
+	}
 
-	if *domain != "" {
+	if *domain != "" || *user != "" {
+		name := *domain
+		if *user != "" {
+			name = *user
+		}
 		password := []byte(*cl_password)
 		if len(password) == 0 {
-			os.Stdout.Write([]byte("Enter password for " + *domain + ":"))
+			os.Stdout.Write([]byte("Enter password for " + name + ":"))
 			password1, err := terminal.ReadPassword(0)
 			if err != nil {
 				log.Fatal("password error: ", err)
@@ -513,11 +815,62 @@ func main() {
 		}
 		//log.Println("read password:", "\"" + string(password) + "\"")
 
-		updateConf(conf, *conf_file, *domain, *virtual, password)
+		if *user != "" {
+			updateUser(conf, *conf_file, *user, *grants, password)
+		} else {
+			updateConf(conf, *conf_file, *domain, *virtual, password)
+		}
 		log.Println("updated conf", *conf_file)
 		return
 	}
 
+	if *token != "" {
+		createToken(conf, *conf_file, *token, *scope, *token_days, *comment)
+		return
+	}
+	if *revoke != "" {
+		revokeToken(conf, *conf_file, *revoke)
+		log.Println("revoked token", *revoke)
+		return
+	}
+	if *tokens {
+		listTokens(conf)
+		return
+	}
+	if *totp != "" {
+		enrollTOTP(conf, *conf_file, *totp)
+		return
+	}
+	if *no_totp != "" {
+		setTOTP(&conf, *no_totp, "", nil)
+		writeConf(conf, *conf_file)
+		log.Println("turned off two-factor authentication for", *no_totp)
+		return
+	}
+	if *lockouts {
+		listLockouts(conf.LockoutFile)
+		return
+	}
+	if *unlock != "" {
+		clearLockouts(conf.LockoutFile, *unlock)
+		log.Println("cleared failed logins of", *unlock)
+		return
+	}
+
+	if *check {
+		if !checkMaps(conf.Domains) {
+			os.Exit(1)
+		}
+		log.Println("all map files are up to date")
+		return
+	}
+	err := openStores(conf.Domains)
+	if err != nil {
+		log.Fatal("could not open alias database: ", err)
+	}
+	checkMaps(conf.Domains)
+	startWatching(conf.Domains)
+
 	// profiler
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -536,12 +889,19 @@ func main() {
 		}()
 	}
 
+	openAuditLog(conf.AuditLog)
+	startSocketmap(conf.SocketMap, conf.Domains)
+	startTCPTables(tcp_listeners, conf.Domains)
+	startPolicyService(conf.PolicyService, conf.Domains)
+	startMailLog(conf.MailLog, conf.Domains)
+
 	// serve go:embed embedded assets
 	assetHandler := http.FileServer(http.FS(staticAssets))
 
 	// Echo instance
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = clientIPExtractor(trusted_proxies)
 
 	r := Renderer{}
 	r.Load()
@@ -552,8 +912,16 @@ func main() {
 		e.Use(mw.Logger())
 	}
 	e.Use(mw.Recover())
+	e.Use(mw.RequestID())
 	e.Use(SecurityHeaders)
-	e.Use(BasicAuth)
+	if conf.ProxyAuthHeader != "" {
+		e.Use(ProxyAuth)
+	} else if conf.SessionLogin {
+		e.Use(SessionAuth)
+	} else {
+		e.Use(BasicAuth)
+	}
+	e.Use(SelectDomain)
 	//e.Use(mw.Gzip())
 
 	//e.Favicon("img/favicon.ico")
@@ -569,7 +937,30 @@ func main() {
 	})
 	e.GET("/", View)
 	e.GET("/view.js", JS)
-	e.POST("/", Change)
+	e.GET("/version", Version)
+	e.GET("/jobs/:id", JobStatus)
+	e.GET("/login", LoginForm)
+	e.POST("/login", Login)
+	e.POST("/logout", Logout, CheckCSRF)
+	e.POST("/", Change, CheckCSRF, RequireRole(RoleEditor, RoleSelf))
+	e.GET("/history", History, RequireRole(RoleViewer), RequireWholeDomain)
+	e.GET("/history/:id", HistoryRevision, RequireRole(RoleViewer), RequireWholeDomain)
+	e.POST("/history/:id/restore", Restore, CheckCSRF, RequireRole(RoleEditor), RequireWholeDomain)
+	e.GET("/audit", Audit, RequireRole(RoleAdmin), RequireWholeDomain)
+	e.GET("/report", Report, RequireRole(RoleViewer), RequireWholeDomain)
+	e.GET("/dashboard", Dashboard, RequireSuperAdmin)
+
+	// JSON REST API
+	e.GET("/api/v1/domains", APIDashboard, RequireSuperAdmin)
+	api := e.Group("/api/v1/domains/:domain", APIDomain)
+	api.GET("/aliases", APIListAliases)
+	api.GET("/aliases/:alias", APIGetAlias)
+	api.POST("/aliases", APICreateAlias, RequireRole(RoleEditor, RoleSelf))
+	api.PUT("/aliases/:alias", APIUpdateAlias, RequireRole(RoleEditor, RoleSelf))
+	api.DELETE("/aliases/:alias", APIDeleteAlias, RequireRole(RoleEditor, RoleSelf))
+	api.GET("/audit", APIAudit, RequireRole(RoleAdmin), RequireWholeDomain)
+	api.GET("/report", APIReport, RequireRole(RoleViewer), RequireWholeDomain)
+	api.GET("/jobs/:id", JobStatus)
 
 	// Start server
 	log.Println("starting postmapweb on", *port)
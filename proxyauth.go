@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Reverse proxy authentication: with ProxyAuthHeader set, e.g. to
+// X-Remote-User, the user name is taken from that header as set by a
+// reverse proxy doing single sign-on, instead of asking for a password. The
+// header is only trusted from the addresses in TrustedProxies, and the user
+// gets the roles granted to them in the users section of the config. API
+// tokens still work.
+
+// proxies allowed to set the authentication header
+var trusted_proxies []*net.IPNet
+
+// parseTrustedProxies parses the TrustedProxies of the config, CIDR
+// blocks or single addresses
+func parseTrustedProxies(conf Config) ([]*net.IPNet, error) {
+	if conf.ProxyAuthHeader != "" && len(conf.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("ProxyAuthHeader requires the addresses of the proxies in TrustedProxies")
+	}
+	nets := make([]*net.IPNet, 0, len(conf.TrustedProxies))
+	for _, proxy := range conf.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %q: %v", proxy, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIPExtractor returns how RealIP finds the client's address: from the
+// X-Forwarded-For header of requests coming through a trusted proxy,
+// otherwise the address the request comes from, as clients could send any
+// X-Forwarded-For header to get around the lockouts of failed logins
+func clientIPExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range proxies {
+		options = append(options, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// fromTrustedProxy tells whether the request comes straight from a trusted
+// proxy. It must not use RealIP, which is the client behind the proxy.
+func fromTrustedProxy(c echo.Context) bool {
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		host = c.Request().RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted_proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyAuth authenticates requests with the user name in the header set by
+// a trusted reverse proxy
+func ProxyAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if strings.HasPrefix(auth, Bearer+" ") {
+			return tokenAuth(c, next, strings.TrimSpace(auth[len(Bearer)+1:]))
+		}
+		if !fromTrustedProxy(c) {
+			return echo.NewHTTPError(http.StatusForbidden, "requests must go through the authenticating proxy")
+		}
+		name := strings.TrimSpace(c.Request().Header.Get(conf.ProxyAuthHeader))
+		if name == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized, "the proxy did not authenticate the user")
+		}
+		// domain logins are for passwords, the proxy could well pass a
+		// user named like a domain
+		user, ok := findConfiguredUser(name)
+		if !ok {
+			auditAuthFailure(c, name)
+			return echo.NewHTTPError(http.StatusForbidden, "unknown user "+name)
+		}
+		c.Set("user", user)
+		return next(c)
+	}
+}
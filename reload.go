@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Postfix reloads are coalesced: a reload is delayed by the configured
+// window, and a reload requested while another is pending or running waits
+// for the next one, which is shared by every request made in the meantime,
+// so bursts of changes only reload Postfix once or twice instead of once
+// each.
+
+type reloadCall struct {
+	done chan struct{}
+	err  error
+}
+
+var reloader = struct {
+	sync.Mutex
+	running bool
+	next    *reloadCall
+}{}
+
+// reloadPostfix runs postfix reload, making sure the reload starts after the
+// call, and returns its outcome
+func reloadPostfix() error {
+	reloader.Lock()
+	call := reloader.next
+	if call == nil {
+		call = &reloadCall{done: make(chan struct{})}
+		reloader.next = call
+	}
+	if !reloader.running {
+		reloader.running = true
+		go runReloads()
+	}
+	reloader.Unlock()
+	<-call.done
+	return call.err
+}
+
+func runReloads() {
+	// batch the requests made within the window
+	time.Sleep(time.Duration(conf.ReloadWindow) * time.Second)
+	reloader.Lock()
+	for reloader.next != nil {
+		call := reloader.next
+		reloader.next = nil
+		reloader.Unlock()
+		cmd := exec.Command("postfix", "reload")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		call.err = cmd.Run()
+		close(call.done)
+		reloader.Lock()
+	}
+	reloader.running = false
+	reloader.Unlock()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Alias scopes: self users only have access to their own address and the
+// aliases forwarding to it, and grants with a pattern only to the aliases
+// whose local part matches it, e.g. sales-* for a department sharing the
+// map file of a domain with others.
+
+type aliasScope struct {
+	// address of a self user
+	owner string
+	// patterns of the local parts, see path.Match
+	patterns []string
+}
+
+// requestScope returns the aliases the request's user has access to
+func requestScope(c echo.Context) aliasScope {
+	var scope aliasScope
+	if hasRole(c, RoleSelf) {
+		scope.owner = strings.ToLower(c.Get("user").(User).Name)
+	}
+	scope.patterns, _ = c.Get("patterns").([]string)
+	return scope
+}
+
+// whole tells whether the scope is the whole domain
+func (scope aliasScope) whole() bool {
+	return scope.owner == "" && scope.patterns == nil
+}
+
+func (scope aliasScope) String() string {
+	if scope.owner != "" {
+		return "your own address and the aliases that forward to it"
+	}
+	return "the aliases matching " + strings.Join(scope.patterns, ", ")
+}
+
+// matches tells whether the local part of the alias matches one of the
+// patterns
+func (scope aliasScope) matches(alias string) bool {
+	local := strings.ToLower(alias)
+	if i := strings.LastIndexByte(local, '@'); i >= 0 {
+		local = local[:i]
+	}
+	for _, pattern := range scope.patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), local); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// owns tells whether the alias is the owner's address, or forwards to it
+func (scope aliasScope) owns(a Alias) bool {
+	if strings.EqualFold(a.Email, scope.owner) {
+		return true
+	}
+	for _, target := range strings.Split(a.Target, ",") {
+		if strings.EqualFold(strings.TrimSpace(target), scope.owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells whether the alias is in the scope
+func (scope aliasScope) contains(a Alias) bool {
+	switch {
+	case scope.owner != "":
+		return scope.owns(a)
+	case scope.patterns != nil:
+		return scope.matches(a.Email)
+	}
+	return true
+}
+
+// filter returns the aliases in the scope
+func (scope aliasScope) filter(aliases []Alias) []Alias {
+	if scope.whole() {
+		return aliases
+	}
+	in_scope := make([]Alias, 0)
+	for _, a := range aliases {
+		if scope.contains(a) {
+			in_scope = append(in_scope, a)
+		}
+	}
+	return in_scope
+}
+
+// targetSet returns the lowercased addresses of a target list
+func targetSet(target string) map[string]bool {
+	set := make(map[string]bool)
+	for _, dest := range strings.Split(target, ",") {
+		if dest = strings.ToLower(strings.TrimSpace(dest)); dest != "" {
+			set[dest] = true
+		}
+	}
+	return set
+}
+
+// allows tells whether a change is in the scope. A self user can change or
+// remove the alias of their own address as they wish, but in the other
+// aliases forwarding to them, which others may share, they can only add or
+// remove their own address.
+func (scope aliasScope) allows(change ChangeRequest, previous string, exists bool) bool {
+	if scope.owner == "" {
+		return scope.contains(Alias{change.Alias, change.Target})
+	}
+	if strings.EqualFold(change.Alias, scope.owner) {
+		return true
+	}
+	if change.Op != "add" || !exists || !scope.owns(Alias{change.Alias, previous}) {
+		return false
+	}
+	before, after := targetSet(previous), targetSet(change.Target)
+	for dest := range before {
+		if !after[dest] && dest != scope.owner {
+			return false
+		}
+	}
+	for dest := range after {
+		if !before[dest] && dest != scope.owner {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireWholeDomain refuses requests from users who only have access to
+// some of the domain's aliases, for pages showing all of them
+func RequireWholeDomain(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		scope := requestScope(c)
+		if scope.whole() {
+			return next(c)
+		}
+		msg := "you only have access to " + scope.String()
+		if strings.HasPrefix(c.Path(), "/api/") {
+			return apiError(c, http.StatusForbidden, msg)
+		}
+		return c.Render(http.StatusForbidden, "error", ErrorPage{msg, nil})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestAliasScopeAllows(t *testing.T) {
+	self := aliasScope{owner: "me@example.com"}
+	sales := aliasScope{patterns: []string{"sales-*"}}
+	tests := []struct {
+		name     string
+		scope    aliasScope
+		change   ChangeRequest
+		previous string
+		exists   bool
+		want     bool
+	}{
+		{"create own address", self, ChangeRequest{"add", "me@example.com", "me@gmail.com"}, "", false, true},
+		{"rewrite own address", self, ChangeRequest{"add", "Me@example.com", "other@gmail.com"}, "me@gmail.com", true, true},
+		{"remove own address", self, ChangeRequest{"remove", "me@example.com", ""}, "me@gmail.com", true, true},
+		{"create another alias", self, ChangeRequest{"add", "new@example.com", "me@example.com"}, "", false, false},
+		{"leave a shared alias", self, ChangeRequest{"add", "team@example.com", "bob@example.com"}, "me@example.com, bob@example.com", true, true},
+		{"reorder a shared alias", self, ChangeRequest{"add", "team@example.com", "bob@example.com,ME@example.com"}, "me@example.com, bob@example.com", true, true},
+		{"remove a shared alias", self, ChangeRequest{"remove", "team@example.com", ""}, "me@example.com, bob@example.com", true, false},
+		{"drop others from a shared alias", self, ChangeRequest{"add", "team@example.com", "me@example.com"}, "me@example.com, bob@example.com", true, false},
+		{"add others to a shared alias", self, ChangeRequest{"add", "team@example.com", "me@example.com,bob@example.com,eve@evil.com"}, "me@example.com, bob@example.com", true, false},
+		{"replace the targets of a shared alias", self, ChangeRequest{"add", "team@example.com", "eve@evil.com"}, "me@example.com", true, false},
+		{"join an alias", self, ChangeRequest{"add", "postmaster@example.com", "root@example.com,me@example.com"}, "root@example.com", true, false},
+		{"remove an alias", self, ChangeRequest{"remove", "postmaster@example.com", ""}, "root@example.com", true, false},
+		{"matching alias", sales, ChangeRequest{"add", "sales-eu@example.com", "x@example.com"}, "", false, true},
+		{"other alias", sales, ChangeRequest{"remove", "support@example.com", ""}, "x@example.com", true, false},
+		{"whole domain", aliasScope{}, ChangeRequest{"remove", "support@example.com", ""}, "x@example.com", true, true},
+	}
+	for _, test := range tests {
+		got := test.scope.allows(test.change, test.previous, test.exists)
+		if got != test.want {
+			t.Errorf("%s: allows(%v, %q, %v) = %v, want %v", test.name, test.change, test.previous, test.exists, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Session login: with SessionLogin set in the config, the web interface uses
+// a login page and session cookies instead of HTTP basic authentication,
+// which browsers cache until they are closed. Sessions are kept in memory and
+// expire after SessionIdleMinutes of inactivity or SessionMaxHours after
+// login. The JSON API keeps using basic authentication.
+//
+// Forms carry a CSRF token whatever the authentication: the session's own
+// with session login, otherwise one derived from the user name, and the
+// login form has its own, double-submitted in a cookie.
+
+const (
+	sessionCookie        = "postmapweb_session"
+	loginCookie          = "postmapweb_login"
+	defaultSessionIdle   = 30 * time.Minute
+	defaultSessionMaxAge = 12 * time.Hour
+)
+
+type Session struct {
+	ID       string
+	User     string
+	CSRF     string
+	Created  time.Time
+	LastSeen time.Time
+}
+
+var sessions = struct {
+	sync.Mutex
+	// signs the session IDs in the cookies
+	key  []byte
+	byID map[string]*Session
+	// derives the CSRF tokens of users without a session
+	csrf_key []byte
+}{byID: make(map[string]*Session), csrf_key: []byte(randomToken())}
+
+func sessionIdle() time.Duration {
+	if conf.SessionIdleMinutes > 0 {
+		return time.Duration(conf.SessionIdleMinutes) * time.Minute
+	}
+	return defaultSessionIdle
+}
+
+func sessionMaxAge() time.Duration {
+	if conf.SessionMaxHours > 0 {
+		return time.Duration(conf.SessionMaxHours) * time.Hour
+	}
+	return defaultSessionMaxAge
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, sessions.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// expired tells whether the session timed out. The caller must hold the
+// sessions lock.
+func (s *Session) expired(now time.Time) bool {
+	return now.Sub(s.LastSeen) > sessionIdle() || now.Sub(s.Created) > sessionMaxAge()
+}
+
+// newSession logs the user in, returning the value of the session cookie
+func newSession(user string) (*Session, string) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.key == nil {
+		sessions.key = []byte(randomToken())
+	}
+	now := time.Now()
+	for id, s := range sessions.byID {
+		if s.expired(now) {
+			delete(sessions.byID, id)
+		}
+	}
+	s := &Session{
+		ID:       randomToken(),
+		User:     user,
+		CSRF:     randomToken(),
+		Created:  now,
+		LastSeen: now,
+	}
+	sessions.byID[s.ID] = s
+	return s, s.ID + "." + signSessionID(s.ID)
+}
+
+// findSession returns the session of a cookie value, if it is valid and has
+// not expired, and records its use
+func findSession(value string) (Session, bool) {
+	id, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return Session{}, false
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.key == nil || !hmac.Equal([]byte(signature), []byte(signSessionID(id))) {
+		return Session{}, false
+	}
+	s, ok := sessions.byID[id]
+	if !ok {
+		return Session{}, false
+	}
+	now := time.Now()
+	if s.expired(now) {
+		delete(sessions.byID, id)
+		return Session{}, false
+	}
+	s.LastSeen = now
+	return *s, true
+}
+
+func endSession(id string) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.byID, id)
+}
+
+func setSessionCookie(c echo.Context, value string, expires time.Time) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		// lax so links to postmapweb from elsewhere keep the user logged
+		// in, forms are protected by the CSRF token
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfToken returns the CSRF token forms must include, or "" if the
+// request is not authenticated
+func csrfToken(c echo.Context) string {
+	if s, ok := c.Get("session").(Session); ok {
+		return s.CSRF
+	}
+	user, ok := c.Get("user").(User)
+	if !ok {
+		return ""
+	}
+	mac := hmac.New(sha256.New, sessions.csrf_key)
+	mac.Write([]byte(user.Name))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SessionAuth authenticates web requests with the session cookie, sending
+// the browser to the login page if there is none. API requests are
+// authenticated by BasicAuth.
+func SessionAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	basic := BasicAuth(next)
+	return func(c echo.Context) error {
+		path := c.Path()
+		switch {
+		case strings.HasPrefix(path, "/api/"):
+			return basic(c)
+		case path == "/login" || strings.HasPrefix(path, "/static/"):
+			return next(c)
+		}
+		if cookie, err := c.Cookie(sessionCookie); err == nil {
+			if s, ok := findSession(cookie.Value); ok {
+				if user, ok := findUser(s.User); ok {
+					c.Set("user", user)
+					c.Set("session", s)
+					return next(c)
+				}
+			}
+		}
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+// CheckCSRF refuses form submissions without the user's CSRF token
+func CheckCSRF(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := csrfToken(c)
+		if token == "" || subtle.ConstantTimeCompare([]byte(c.FormValue("csrf")), []byte(token)) != 1 {
+			return c.Render(http.StatusForbidden, "error", ErrorPage{"invalid or missing CSRF token, reload the page and try again", nil})
+		}
+		return next(c)
+	}
+}
+
+// LoginPage is the data for the login template
+type LoginPage struct {
+	Error string
+	CSRF  string
+}
+
+// renderLogin shows the login form with a fresh CSRF token, also set in a
+// cookie, so logins cannot be forged by other sites
+func renderLogin(c echo.Context, status int, message string) error {
+	token := randomToken()
+	c.SetCookie(&http.Cookie{
+		Name:     loginCookie,
+		Value:    token,
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	return c.Render(status, "login", LoginPage{message, token})
+}
+
+func LoginForm(c echo.Context) error {
+	return renderLogin(c, http.StatusOK, "")
+}
+
+func Login(c echo.Context) error {
+	cookie, err := c.Cookie(loginCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.FormValue("csrf")), []byte(cookie.Value)) != 1 {
+		return renderLogin(c, http.StatusForbidden, "The login form expired, please try again.")
+	}
+	name := strings.TrimSpace(c.FormValue("user"))
+	if wait := authLocked(c, name); wait > 0 {
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+		return renderLogin(c, http.StatusTooManyRequests, "Too many failed logins, try again in "+wait.Round(time.Second).String()+".")
+	}
+	user, ok := authenticate(name, c.FormValue("password"))
+	ok = ok && checkSecondFactor(user, c.FormValue("code"))
+	if !ok {
+		authFailed(c, name)
+		auditAuthFailure(c, name)
+		return renderLogin(c, http.StatusUnauthorized, "Invalid user name, password or authentication code.")
+	}
+	authSucceeded(c, name)
+	s, value := newSession(user.Name)
+	setSessionCookie(c, value, s.Created.Add(sessionMaxAge()))
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func Logout(c echo.Context) error {
+	if s, ok := c.Get("session").(Session); ok {
+		endSession(s.ID)
+	}
+	setSessionCookie(c, "", time.Unix(0, 0))
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Built-in socketmap(5) server, so Postfix can query the aliases directly
+// with e.g. virtual_alias_maps = socketmap:unix:/path/to/socket:virtual
+// without postmap or reloads. Lookups are answered from the in-memory index,
+// see index.go.
+
+// requests are a map name and a key, well below Postfix's own limits
+const (
+	socketmapMaxRequest = 10000
+	socketmapMaxDigits  = 5
+	socketmapIdle       = 100 * time.Second
+)
+
+var ErrBadNetstring = errors.New("malformed netstring")
+
+// readNetstring reads the length digits one at a time, as a client sending
+// endless digits must not make us buffer them
+func readNetstring(r *bufio.Reader) (string, error) {
+	size_str := make([]byte, 0, socketmapMaxDigits)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ':' {
+			break
+		}
+		if c < '0' || c > '9' || len(size_str) == socketmapMaxDigits {
+			return "", ErrBadNetstring
+		}
+		size_str = append(size_str, c)
+	}
+	size, err := strconv.Atoi(string(size_str))
+	if err != nil || size > socketmapMaxRequest {
+		return "", ErrBadNetstring
+	}
+	data := make([]byte, size+1)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return "", err
+	}
+	if data[size] != ',' {
+		return "", ErrBadNetstring
+	}
+	return string(data[:size]), nil
+}
+
+func writeNetstring(w io.Writer, reply string) error {
+	_, err := fmt.Fprintf(w, "%d:%s,", len(reply), reply)
+	return err
+}
+
+// serveSocketmap answers the requests of a Postfix client, which keeps the
+// connection open for further lookups
+func serveSocketmap(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(socketmapIdle))
+		request, err := readNetstring(r)
+		if err != nil {
+			if err != io.EOF && *verbose {
+				log.Println("socketmap connection closed due to", err)
+			}
+			return
+		}
+		var reply string
+		name, key, ok := strings.Cut(request, " ")
+		switch {
+		case !ok || key == "":
+			reply = "PERM malformed request"
+		case name != "virtual" && name != "access":
+			reply = "PERM unknown map " + name
+		default:
+			value, found := lookupKey(name, key, nil)
+			if found {
+				reply = "OK " + value
+			} else {
+				reply = "NOTFOUND "
+			}
+		}
+		if *verbose {
+			log.Println("socketmap lookup:", request, "→", reply)
+		}
+		if writeNetstring(conn, reply) != nil {
+			return
+		}
+	}
+}
+
+// startSocketmap indexes the domains' maps and serves them on the unix
+// socket, if one is configured
+func startSocketmap(socket_file string, domains []Domain) {
+	if socket_file == "" {
+		return
+	}
+	startIndex(domains)
+	// remove the socket left behind by a previous run
+	os.Remove(socket_file)
+	l, err := net.Listen("unix", socket_file)
+	if err != nil {
+		log.Fatal("could not listen on socketmap socket ", socket_file, " due to ", err)
+	}
+	// the Postfix daemons must be able to connect
+	err = os.Chmod(socket_file, 0660)
+	if err != nil {
+		log.Fatal("could not set permissions of socketmap socket ", socket_file, " due to ", err)
+	}
+	log.Println("serving socketmap lookups on", socket_file)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println("could not accept socketmap connection due to", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go serveSocketmap(conn)
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"os"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite alias store: the domain's MapFile is a SQLite database that Postfix
+// queries with sqlite_table(5) maps, so changes take effect as soon as they
+// are committed, without postmap or postfix reload. Aliases live in the
+// aliases table, and spam recipients in the spam table for use with
+// check_recipient_access. Keys are matched case-insensitively like Postfix
+// does with its other lookup tables.
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS aliases (
+	alias  TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+	target TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS spam (
+	recipient TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+	action    TEXT NOT NULL
+);
+`
+
+// open databases, by file name
+var sqlite_dbs = struct {
+	sync.Mutex
+	dbs map[string]*sql.DB
+}{dbs: make(map[string]*sql.DB)}
+
+// openSQLite opens a database, creating it and its tables if needed
+func openSQLite(file_name string) (*sql.DB, error) {
+	sqlite_dbs.Lock()
+	defer sqlite_dbs.Unlock()
+	if db, ok := sqlite_dbs.dbs[file_name]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("sqlite", "file:"+file_name+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	sqlite_dbs.dbs[file_name] = db
+	return db, nil
+}
+
+// openStores creates the databases of SQLite-backed domains, so they can be
+// locked and watched
+func openStores(domains []Domain) error {
+	for _, d := range domains {
+		if d.MapType != "sqlite" {
+			continue
+		}
+		_, err := openSQLite(d.MapFile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqliteStore struct {
+	domain Domain
+}
+
+func (s sqliteStore) Load() ([]byte, []byte, error) {
+	db, err := openSQLite(s.domain.MapFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	map_data, err := dumpTable(tx, "SELECT alias, target FROM aliases ORDER BY alias")
+	if err != nil {
+		return nil, nil, err
+	}
+	spam_data, err := dumpTable(tx, "SELECT recipient, action FROM spam ORDER BY recipient")
+	if err != nil {
+		return nil, nil, err
+	}
+	return map_data, spam_data, nil
+}
+
+// dumpTable returns the rows of a key/value query in map file format
+func dumpTable(tx *sql.Tx, query string) ([]byte, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		new_line("SQL", w, key, value)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	err = w.Flush()
+	return buf.Bytes(), err
+}
+
+// updateTable makes the rows of a key/value table match the entries of a
+// map, only inserting, updating and deleting the rows that differ
+func updateTable(tx *sql.Tx, table string, key_column string, value_column string, map_name string, data []byte) error {
+	keys, values, err := parseMapEntries(bytes.NewReader(data), map_name, false)
+	if err != nil {
+		return err
+	}
+	// keys are case-insensitive, like the primary keys
+	current := make(map[string]Alias)
+	rows, err := tx.Query("SELECT " + key_column + ", " + value_column + " FROM " + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Alias
+		err = rows.Scan(&a.Email, &a.Target)
+		if err != nil {
+			return err
+		}
+		current[strings.ToLower(a.Email)] = a
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	upsert, err := tx.Prepare("INSERT INTO " + table + " (" + key_column + ", " + value_column + ") VALUES (?, ?) " +
+		"ON CONFLICT (" + key_column + ") DO UPDATE SET " + key_column + " = excluded." + key_column + ", " + value_column + " = excluded." + value_column)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	for i, key := range keys {
+		a, ok := current[strings.ToLower(key)]
+		delete(current, strings.ToLower(key))
+		if ok && a.Email == key && a.Target == values[i] {
+			continue
+		}
+		_, err = upsert.Exec(key, values[i])
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range current {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE "+key_column+" = ?", a.Email)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Install updates the rows that changed in a single transaction. Like
+// installMapFiles, the previous contents are kept in map file format with a
+// .old suffix.
+func (s sqliteStore) Install(map_data []byte, spam_data []byte) ([]Step, error) {
+	old_map, old_spam, err := s.Load()
+	if err != nil {
+		return nil, &StageError{"prepare", err}
+	}
+	db, _ := openSQLite(s.domain.MapFile)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, &StageError{"prepare", err}
+	}
+	defer tx.Rollback()
+	err = updateTable(tx, "aliases", "alias", "target", s.domain.MapFile, map_data)
+	if err == nil {
+		err = updateTable(tx, "spam", "recipient", "action", s.domain.MapFile+".spam", spam_data)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	steps := []Step{newStep("sqlite", err)}
+	if err != nil {
+		return steps, &StageError{"commit", err}
+	}
+	// our own connection stays open, so the watcher will not notice
+	mapChanged(s.domain.MapFile)
+	os.WriteFile(s.domain.MapFile+".old", old_map, 0644)
+	os.WriteFile(s.domain.MapFile+".spam.old", old_spam, 0644)
+	return steps, nil
+}
+
+func (s sqliteStore) NeedsReload() bool {
+	return false
+}
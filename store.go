@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// Alias stores hold a domain's aliases: either Postfix map files compiled by
+// a map backend, or a SQLite database Postfix queries directly. Both take
+// and return the aliases in map file format, so changes, previews and the
+// history work the same whatever the store.
+
+// AliasStore reads and replaces a domain's main and spam maps
+type AliasStore interface {
+	// Load returns the contents of the main and spam maps
+	Load() ([]byte, []byte, error)
+	// Install replaces the main and spam maps, on failure a *StageError
+	// says which stage failed
+	Install(map_data []byte, spam_data []byte) ([]Step, error)
+	// NeedsReload tells whether Postfix must be reloaded to see the changes
+	NeedsReload() bool
+}
+
+// fileStore keeps the aliases in the map file and its .spam companion
+type fileStore struct {
+	domain Domain
+}
+
+func (s fileStore) Load() ([]byte, []byte, error) {
+	map_data, err := os.ReadFile(s.domain.MapFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the spam map may not exist yet
+	spam_data, err := os.ReadFile(s.domain.MapFile + ".spam")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return map_data, spam_data, nil
+}
+
+func (s fileStore) Install(map_data []byte, spam_data []byte) ([]Step, error) {
+	return installMapFiles(s.domain, map_data, spam_data)
+}
+
+func (s fileStore) NeedsReload() bool {
+	// the socketmap server picks up changes by itself
+	return s.domain.MapType != "socketmap"
+}
+
+// aliasStore returns the store for the domain's map type
+func aliasStore(domain Domain) (AliasStore, error) {
+	if domain.MapType == "sqlite" {
+		return sqliteStore{domain}, nil
+	}
+	_, err := mapBackend(domain)
+	if err != nil {
+		return nil, err
+	}
+	return fileStore{domain}, nil
+}
+
+// loadMaps returns the contents of the domain's main and spam maps.
+//
+// The caller must hold the map lock, see lockMap.
+func loadMaps(domain Domain) ([]byte, []byte, error) {
+	store, err := aliasStore(domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	map_data, spam_data, err := store.Load()
+	if err != nil {
+		log.Println("could not read the map of", domain.Name, "due to", err)
+	}
+	return map_data, spam_data, err
+}
+
+// installMaps replaces the domain's main and spam maps.
+//
+// The caller must hold the map lock, see lockMap.
+func installMaps(domain Domain, map_data []byte, spam_data []byte) ([]Step, error) {
+	store, err := aliasStore(domain)
+	if err != nil {
+		return nil, &StageError{"prepare", err}
+	}
+	steps, err := store.Install(map_data, spam_data)
+	if err == nil {
+		indexMaps(domain)
+	}
+	return steps, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Built-in tcp_table(5) server, for Postfix versions without socketmap
+// support, e.g. virtual_alias_maps = tcp:localhost:10041. The protocol has
+// no map names, so each listener serves either the virtual or the access
+// map, optionally restricted to some of the domains. Lookups are answered
+// from the in-memory index, see index.go.
+
+// tcpListener is the value of a -tcp flag: map@address[/domain,...]
+type tcpListener struct {
+	map_name string
+	address  string
+	domains  []string
+}
+
+type tcpListeners []tcpListener
+
+var ErrBadTCPListener = errors.New("expected map@address[/domain,...] where map is virtual or access")
+
+func (l *tcpListeners) String() string {
+	specs := make([]string, 0, len(*l))
+	for _, listener := range *l {
+		spec := listener.map_name + "@" + listener.address
+		if len(listener.domains) > 0 {
+			spec += "/" + strings.Join(listener.domains, ",")
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (l *tcpListeners) Set(value string) error {
+	map_name, address, ok := strings.Cut(value, "@")
+	if !ok || (map_name != "virtual" && map_name != "access") {
+		return ErrBadTCPListener
+	}
+	var listener tcpListener
+	listener.map_name = map_name
+	address, domains, ok := strings.Cut(address, "/")
+	listener.address = address
+	if ok {
+		for _, d := range strings.Split(domains, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "" {
+				return ErrBadTCPListener
+			}
+			listener.domains = append(listener.domains, d)
+		}
+	}
+	*l = append(*l, listener)
+	return nil
+}
+
+// tcpEncode escapes characters the protocol does not allow in keys and
+// replies
+func tcpEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// keyDomain returns the domain of a lookup key, i.e. an address, @domain or
+// a bare domain name
+func keyDomain(key string) string {
+	if i := strings.LastIndexByte(key, '@'); i >= 0 {
+		return strings.ToLower(key[i+1:])
+	}
+	return strings.ToLower(key)
+}
+
+// tcpReply answers a request line
+func (listener tcpListener) tcpReply(request string, map_files []string) string {
+	cmd, key, ok := strings.Cut(request, " ")
+	if !ok || cmd != "get" {
+		return "500 " + tcpEncode("unsupported request")
+	}
+	key, err := url.PathUnescape(key)
+	if err != nil || key == "" {
+		return "500 " + tcpEncode("malformed key")
+	}
+	if listener.domains != nil && !slices.Contains(listener.domains, keyDomain(key)) {
+		return "500 " + tcpEncode("not found")
+	}
+	value, found := lookupKey(listener.map_name, key, map_files)
+	if !found {
+		return "500 " + tcpEncode("not found")
+	}
+	return "200 " + tcpEncode(value)
+}
+
+func (listener tcpListener) serve(conn net.Conn, map_files []string) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, socketmapMaxRequest)
+	for {
+		conn.SetDeadline(time.Now().Add(socketmapIdle))
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if *verbose && len(line) > 0 {
+				log.Println("tcp_table connection closed due to", err)
+			}
+			return
+		}
+		request := strings.TrimRight(string(line), "\r\n")
+		reply := listener.tcpReply(request, map_files)
+		if *verbose {
+			log.Println("tcp_table lookup:", listener.map_name, request, "→", reply)
+		}
+		_, err = conn.Write([]byte(reply + "\n"))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// startTCPTables indexes the domains' maps and serves them on the tcp_table
+// listeners
+func startTCPTables(listeners tcpListeners, domains []Domain) {
+	if len(listeners) == 0 {
+		return
+	}
+	startIndex(domains)
+	for _, listener := range listeners {
+		var map_files []string
+		for _, name := range listener.domains {
+			found := false
+			for _, d := range domains {
+				if strings.EqualFold(d.Name, name) {
+					map_files = append(map_files, d.MapFile)
+					found = true
+				}
+			}
+			if !found {
+				log.Fatal("unknown domain ", name, " for tcp_table listener ", listener.address)
+			}
+		}
+		l, err := net.Listen("tcp", listener.address)
+		if err != nil {
+			log.Fatal("could not listen for tcp_table lookups on ", listener.address, " due to ", err)
+		}
+		log.Println("serving tcp_table lookups of the", listener.map_name, "map on", listener.address)
+		go func(listener tcpListener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					log.Println("could not accept tcp_table connection due to", err)
+					time.Sleep(time.Second)
+					continue
+				}
+				go listener.serve(conn, map_files)
+			}
+		}(listener)
+	}
+}
@@ -1,4 +1,7 @@
 var data = {{.Aliases}};
+var version = {{.Version}};
+var hits = {{.Hits}};
+var read_only = {{.ReadOnly}};
 var changes = {};
 function add_change(cl, s) {
     var n = document.createElement("li");
@@ -21,7 +24,7 @@ function show_changes() {
                 "alias": changes[cell]["is"],
                 "target": changes[cell]["target"]});
     }
-    document.forms[1].changes.value = JSON.stringify(l);
+    document.getElementById("changes").value = JSON.stringify(l);
 }
 function change_handler(change, source) {
     if (source === 'loadData') {
@@ -46,6 +49,7 @@ function change_handler(change, source) {
             if (newVal.indexOf("@{{.Domain}}") == -1) {
                 hot.getCell(cell, 0).style.backgroundColor = "#fc9";
                 document.getElementById("submit").disabled = true;
+                document.getElementById("preview").disabled = true;
                 errored[cell] = true;
             } else {
                 hot.getCell(cell, 0).style.backgroundColor = "#fff";
@@ -54,6 +58,7 @@ function change_handler(change, source) {
                     hot.getCell(cell, 0).style.backgroundColor = "#fff";
                     if (Object.keys(errored).length == 0) {
                         document.getElementById("submit").disabled = false;
+                        document.getElementById("preview").disabled = false;
                     }
                 }
             }
@@ -75,16 +80,67 @@ function check_pending() {
     return true;
 }
 
+// warn if the map file changed since the page was loaded
+function check_version() {
+    fetch("/version", {credentials: "same-origin"})
+        .then(function(response) { return response.json(); })
+        .then(function(v) {
+            document.getElementById("stale").hidden = (v.version == version);
+        })
+        .catch(function() {});
+}
+setInterval(check_version, 15000);
+
+// follow the reload and script hook run after changes were submitted
+function check_job() {
+    var p = document.getElementById("job");
+    if (p == null) {
+        return;
+    }
+    fetch("/jobs/" + p.dataset.job, {credentials: "same-origin"})
+        .then(function(response) { return response.json(); })
+        .then(function(job) {
+            switch (job.status) {
+            case "done":
+                p.textContent = "Changes applied.";
+                break;
+            case "failed":
+                p.textContent = "Changes saved, but reloading Postfix or " +
+                    "running the script hook failed: " + job.error;
+                p.className = "job banner";
+                break;
+            default:
+                p.textContent = "Applying changes (" + job.status + ")…";
+                setTimeout(check_job, 2000);
+            }
+        })
+        .catch(function() {});
+}
+
 //document.getElementById("submit").onsubmit = check_pending;
 var errored = {};
 var hot;
 function onload_handler() {
+    check_job();
+    for (var i=0; i<document.forms.length; i++) {
+        if (document.forms[i].version) {
+            document.forms[i].version.value = version;
+        }
+    }
     var container = document.getElementById('spreadsheet');
+    var headers = ["Email alias", "Destination(s)"];
+    var columns = [{readOnly: read_only}, {readOnly: read_only}];
+    if (hits) {
+        // recipient counts from the policy service
+        headers.push("Hits", "Last seen");
+        columns.push({readOnly: true}, {readOnly: true});
+    }
     hot = new Handsontable(container, {
         data: data,
-        minSpareRows: 1,
+        minSpareRows: read_only ? 0 : 1,
         rowHeaders: true,
-        colHeaders: ["Email alias", "Destination(s)"],
+        colHeaders: headers,
+        columns: columns,
         contextMenu: false,
         afterChange: change_handler,
     });
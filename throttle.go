@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Brute-force protection: failed logins are counted per client IP and per
+// configured user, domain or API token, made-up names only count against
+// the IP. After AuthMaxFailures failures in a row, the IP or user is
+// locked out for AuthLockoutSeconds, doubled with every further failure.
+// Failures and lockouts are logged in a format fail2ban can match:
+//
+//	authentication failure: user=<name> rhost=<ip>
+//
+// The counters are saved to LockoutFile whenever a lockout starts or is
+// cleared by a successful login, so lockouts survive restarts and can be
+// listed and cleared with the -lockouts and -unlock flags.
+
+const (
+	defaultAuthMaxFailures    = 5
+	defaultAuthLockoutSeconds = 60
+	maxLockout                = 24 * time.Hour
+	// failures are forgotten after a day without any
+	failureMemory = 24 * time.Hour
+	// limit on the IPs and user names tracked
+	maxThrottleEntries = 10000
+	// how long a successful login is remembered, so basic authentication
+	// does not run bcrypt on every request
+	credentialCacheTime = time.Minute
+)
+
+// verifiedCredential is a successful basic authentication login
+type verifiedCredential struct {
+	verified time.Time
+	expires  time.Time
+	// logins with a two-factor code are kept while in use, like sessions,
+	// as browsers keep sending the same code
+	two_factor bool
+}
+
+// Throttle is the count of failed logins of an IP or user name
+type Throttle struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+var throttles = struct {
+	sync.Mutex
+	// by "ip:<address>" or "user:<name>"
+	entries map[string]*Throttle
+	// modification time of the lockout file when it was last read or
+	// written, to notice changes made with -unlock
+	loaded time.Time
+	// verified credentials, by keyed hash
+	verified map[string]*verifiedCredential
+	key      []byte
+}{
+	entries:  make(map[string]*Throttle),
+	verified: make(map[string]*verifiedCredential),
+	key:      []byte(randomToken()),
+}
+
+func authMaxFailures() int {
+	if conf.AuthMaxFailures > 0 {
+		return conf.AuthMaxFailures
+	}
+	return defaultAuthMaxFailures
+}
+
+// lockoutDuration returns how long a key is locked out after the given
+// number of failures
+func lockoutDuration(failures int) time.Duration {
+	base := time.Duration(conf.AuthLockoutSeconds) * time.Second
+	if base <= 0 {
+		base = defaultAuthLockoutSeconds * time.Second
+	}
+	d := base
+	for i := authMaxFailures(); i < failures && d < maxLockout; i++ {
+		d *= 2
+	}
+	if d > maxLockout {
+		d = maxLockout
+	}
+	return d
+}
+
+// readLockouts reads the lockout file
+func readLockouts(file_name string) (map[string]*Throttle, error) {
+	entries := make(map[string]*Throttle)
+	data, err := os.ReadFile(file_name)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &entries)
+	return entries, err
+}
+
+func writeLockouts(file_name string, entries map[string]*Throttle) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file_name + ".new"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file_name)
+}
+
+// syncLockouts rereads the lockout file if it was changed by someone else.
+// The caller must hold the throttles lock.
+func syncLockouts() {
+	if conf.LockoutFile == "" {
+		return
+	}
+	info, err := os.Stat(conf.LockoutFile)
+	if err != nil || info.ModTime().Equal(throttles.loaded) {
+		return
+	}
+	entries, err := readLockouts(conf.LockoutFile)
+	if err != nil {
+		log.Println("could not read lockouts from", conf.LockoutFile, "due to", err)
+		return
+	}
+	throttles.entries = entries
+	throttles.loaded = info.ModTime()
+}
+
+// saveLockouts writes the counters. The caller must hold the throttles lock.
+func saveLockouts() {
+	if conf.LockoutFile == "" {
+		return
+	}
+	err := writeLockouts(conf.LockoutFile, throttles.entries)
+	if err != nil {
+		log.Println("could not save lockouts to", conf.LockoutFile, "due to", err)
+		return
+	}
+	if info, err := os.Stat(conf.LockoutFile); err == nil {
+		throttles.loaded = info.ModTime()
+	}
+}
+
+// pruneThrottles forgets old failures. The caller must hold the throttles
+// lock.
+func pruneThrottles(now time.Time) {
+	for key, t := range throttles.entries {
+		if now.After(t.LockedUntil) && now.Sub(t.LastFailure) > failureMemory {
+			delete(throttles.entries, key)
+		}
+	}
+}
+
+// knownAccount tells whether a login name is a configured user or domain, or
+// token:<id> of an API token
+func knownAccount(name string) bool {
+	if id, ok := strings.CutPrefix(name, "token:"); ok {
+		for _, t := range currentTokens() {
+			if t.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := findUser(name)
+	return ok
+}
+
+// throttleKeys returns the keys a login counts against. Unknown user names
+// are left out, so they cannot fill the lockout file.
+func throttleKeys(c echo.Context, user string) []string {
+	keys := []string{"ip:" + c.RealIP()}
+	if knownAccount(user) {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// authLocked returns how long logins of the user from the request's IP are
+// locked out for, or 0 if they are not
+func authLocked(c echo.Context, user string) time.Duration {
+	keys := throttleKeys(c, user)
+	throttles.Lock()
+	defer throttles.Unlock()
+	syncLockouts()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		if t, ok := throttles.entries[key]; ok && t.LockedUntil.After(now) && t.LockedUntil.Sub(now) > wait {
+			wait = t.LockedUntil.Sub(now)
+		}
+	}
+	if wait > 0 {
+		log.Printf("authentication blocked: user=%s rhost=%s", strconv.Quote(user), c.RealIP())
+	}
+	return wait
+}
+
+// authFailed counts a failed login, locking the IP or user out if they
+// failed too often
+func authFailed(c echo.Context, user string) {
+	log.Printf("authentication failure: user=%s rhost=%s", strconv.Quote(user), c.RealIP())
+	keys := throttleKeys(c, user)
+	throttles.Lock()
+	defer throttles.Unlock()
+	syncLockouts()
+	now := time.Now()
+	if len(throttles.entries) >= maxThrottleEntries {
+		pruneThrottles(now)
+	}
+	locked := false
+	for _, key := range keys {
+		t, ok := throttles.entries[key]
+		if !ok {
+			if len(throttles.entries) >= maxThrottleEntries {
+				continue
+			}
+			t = &Throttle{}
+			throttles.entries[key] = t
+		}
+		if now.Sub(t.LastFailure) > failureMemory {
+			t.Failures = 0
+		}
+		t.Failures++
+		t.LastFailure = now
+		if t.Failures >= authMaxFailures() {
+			d := lockoutDuration(t.Failures)
+			t.LockedUntil = now.Add(d)
+			locked = true
+			log.Printf("authentication lockout: %s for %s after %d failures rhost=%s", key, d, t.Failures, c.RealIP())
+		}
+	}
+	// the failures before a lockout are only counted in memory
+	if locked {
+		saveLockouts()
+	}
+}
+
+// authSucceeded forgets the failures of the user and IP
+func authSucceeded(c echo.Context, user string) {
+	keys := throttleKeys(c, user)
+	throttles.Lock()
+	defer throttles.Unlock()
+	syncLockouts()
+	changed := false
+	for _, key := range keys {
+		if t, ok := throttles.entries[key]; ok {
+			delete(throttles.entries, key)
+			// only entries that were locked out were saved
+			changed = changed || !t.LockedUntil.IsZero()
+		}
+	}
+	if changed {
+		saveLockouts()
+	}
+}
+
+func credentialHash(user string, password string) string {
+	mac := hmac.New(sha256.New, throttles.key)
+	mac.Write([]byte(user + "\x00" + password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCredentials authenticates a user like authenticateBasic, but
+// remembers successful logins for a while: a minute, or for logins with a
+// two-factor code, until they have not been used for the session idle time
+// or reach the maximum session age
+func checkCredentials(user string, password string) (User, error) {
+	hash := credentialHash(user, password)
+	now := time.Now()
+	throttles.Lock()
+	v, ok := throttles.verified[hash]
+	if ok && now.Before(v.expires) {
+		if v.two_factor {
+			v.expires = now.Add(sessionIdle())
+			if max := v.verified.Add(sessionMaxAge()); v.expires.After(max) {
+				v.expires = max
+			}
+		}
+		throttles.Unlock()
+		u, ok := findUser(user)
+		if !ok {
+			return User{}, ErrInvalidCredentials
+		}
+		return u, nil
+	}
+	throttles.Unlock()
+	u, err := authenticateBasic(user, password)
+	if err == nil {
+		v := &verifiedCredential{verified: now, expires: now.Add(credentialCacheTime)}
+		if u.TOTPSecret != "" {
+			v.two_factor = true
+			v.expires = now.Add(sessionIdle())
+		}
+		throttles.Lock()
+		for h, e := range throttles.verified {
+			if now.After(e.expires) {
+				delete(throttles.verified, h)
+			}
+		}
+		throttles.verified[hash] = v
+		throttles.Unlock()
+	}
+	return u, err
+}
+
+// listLockouts prints the IPs and users with failed logins, for -lockouts
+func listLockouts(file_name string) {
+	entries, err := readLockouts(file_name)
+	if err != nil {
+		log.Fatal("could not read lockouts from ", file_name, " due to ", err)
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	now := time.Now()
+	for _, key := range keys {
+		t := entries[key]
+		status := "not locked"
+		if t.LockedUntil.After(now) {
+			status = "locked until " + t.LockedUntil.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-40s %3d failures, last %s, %s\n", key, t.Failures, t.LastFailure.Local().Format("2006-01-02 15:04:05"), status)
+	}
+}
+
+// clearLockouts forgets the failures of a key (ip:<address> or user:<name>),
+// or of all of them, for -unlock
+func clearLockouts(file_name string, key string) {
+	entries, err := readLockouts(file_name)
+	if err != nil {
+		log.Fatal("could not read lockouts from ", file_name, " due to ", err)
+	}
+	if key == "all" {
+		entries = make(map[string]*Throttle)
+	} else if _, ok := entries[key]; ok {
+		delete(entries, key)
+	} else {
+		log.Fatal("no failed logins for ", key, ", expected ip:<address>, user:<name> or all")
+	}
+	err = writeLockouts(file_name, entries)
+	if err != nil {
+		log.Fatal("could not write lockouts to ", file_name, " due to ", err)
+	}
+}
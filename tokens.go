@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// API tokens let scripts use the JSON API of a domain without a user's
+// password. They are sent as bearer tokens, are created and revoked with
+// the -token and -revoke flags, and only their hash is kept in the config
+// file. Requests made with a token are attributed to token:<id> in the
+// history and audit log. Tokens are reread from the config file when it
+// changes, so revocations take effect without a restart.
+
+const (
+	// list the aliases
+	ScopeRead = "read"
+	// also create aliases
+	ScopeAdd = "add"
+	// also change and delete aliases
+	ScopeWrite = "write"
+
+	Bearer      = "Bearer"
+	tokenPrefix = "pmw_"
+	// hex digits of the token IDs
+	tokenIDLength = 16
+)
+
+// APIToken is a token of the JSON API of a domain
+type APIToken struct {
+	ID      string
+	Domain  string
+	Scope   string
+	Hash    string
+	Created time.Time
+	Expires time.Time
+	Comment string `json:",omitempty"`
+}
+
+var api_tokens = struct {
+	sync.Mutex
+	tokens []APIToken
+	// modification time of the config file when the tokens were last read
+	loaded time.Time
+}{}
+
+// currentTokens returns the tokens of the config file, rereading them if
+// it was changed, e.g. by -revoke
+func currentTokens() []APIToken {
+	api_tokens.Lock()
+	defer api_tokens.Unlock()
+	if api_tokens.loaded.IsZero() {
+		api_tokens.tokens = conf.Tokens
+	}
+	info, err := os.Stat(conf_path)
+	if err != nil || info.ModTime().Equal(api_tokens.loaded) {
+		return api_tokens.tokens
+	}
+	var c Config
+	data, err := os.ReadFile(conf_path)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err == nil {
+		err = checkTokens(c)
+	}
+	if err != nil {
+		// keep the tokens as they were, but try again next time
+		log.Println("could not reread the tokens from", conf_path, "due to", err)
+		return api_tokens.tokens
+	}
+	api_tokens.tokens = c.Tokens
+	api_tokens.loaded = info.ModTime()
+	return api_tokens.tokens
+}
+
+func tokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// findToken returns the token of a bearer token, pmw_<id>_<secret>, if it
+// is valid and has not expired
+func findToken(bearer string) (APIToken, bool) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(bearer, tokenPrefix), "_")
+	if !ok || !strings.HasPrefix(bearer, tokenPrefix) {
+		return APIToken{}, false
+	}
+	for _, t := range currentTokens() {
+		if t.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(tokenHash(secret))) != 1 {
+			return APIToken{}, false
+		}
+		if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+			return APIToken{}, false
+		}
+		return t, true
+	}
+	return APIToken{}, false
+}
+
+// tokenUser is the user a token acts as
+func tokenUser(t APIToken) User {
+	role := RoleViewer
+	if t.Scope != ScopeRead {
+		role = RoleEditor
+	}
+	return User{Name: "token:" + t.ID, Grants: []Grant{{t.Domain, role, ""}}}
+}
+
+// tokenAllows tells whether the token's scope allows the request method,
+// the only API request adding aliases is a POST
+func tokenAllows(t APIToken, method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return t.Scope == ScopeAdd || t.Scope == ScopeWrite
+	}
+	return t.Scope == ScopeWrite
+}
+
+// tokenAuth authenticates an API request with a bearer token
+func tokenAuth(c echo.Context, next echo.HandlerFunc, bearer string) error {
+	name := "token:" + strings.SplitN(strings.TrimPrefix(bearer, tokenPrefix), "_", 2)[0]
+	if !strings.HasPrefix(c.Path(), "/api/") {
+		return apiError(c, http.StatusUnauthorized, "API tokens can only be used with the JSON API")
+	}
+	if authLocked(c, name) > 0 {
+		return apiError(c, http.StatusTooManyRequests, "too many failed logins, try again later")
+	}
+	t, ok := findToken(bearer)
+	if !ok {
+		authFailed(c, name)
+		auditAuthFailure(c, name)
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, Bearer+` error="invalid_token"`)
+		return apiError(c, http.StatusUnauthorized, "invalid or expired token")
+	}
+	if !tokenAllows(t, c.Request().Method) {
+		return apiError(c, http.StatusForbidden, "the scope of this token is "+t.Scope)
+	}
+	c.Set("user", tokenUser(t))
+	return next(c)
+}
+
+// createToken adds a token for a domain to the config file and prints it,
+// for the -token flag
+func createToken(conf Config, conf_file string, domain string, scope string, days int, comment string) {
+	t := APIToken{
+		ID:      randomToken()[:tokenIDLength],
+		Domain:  domain,
+		Scope:   scope,
+		Created: time.Now().UTC(),
+		Comment: comment,
+	}
+	if days > 0 {
+		t.Expires = t.Created.AddDate(0, 0, days)
+	}
+	secret := randomToken()
+	t.Hash = tokenHash(secret)
+	conf.Tokens = append(conf.Tokens, t)
+	err := checkTokens(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeConf(conf, conf_file)
+	fmt.Println("Token", t.ID, "for", domain, "with scope", scope, "(it cannot be shown again):")
+	fmt.Println()
+	fmt.Println("   ", tokenPrefix+t.ID+"_"+secret)
+	fmt.Println()
+	fmt.Println("Send it in an Authorization: Bearer header.")
+}
+
+// revokeToken removes a token from the config file, for the -revoke flag
+func revokeToken(conf Config, conf_file string, id string) {
+	tokens := make([]APIToken, 0, len(conf.Tokens))
+	for _, t := range conf.Tokens {
+		if t.ID != id {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == len(conf.Tokens) {
+		log.Fatal("no such token: ", id)
+	}
+	conf.Tokens = tokens
+	writeConf(conf, conf_file)
+}
+
+// listTokens prints the tokens, for the -tokens flag
+func listTokens(conf Config) {
+	for _, t := range conf.Tokens {
+		expires := "never expires"
+		if !t.Expires.IsZero() {
+			expires = "expires " + t.Expires.Local().Format("2006-01-02 15:04")
+		}
+		line := fmt.Sprintf("%-16s %-30s %-5s created %s, %s", t.ID, t.Domain, t.Scope, t.Created.Local().Format("2006-01-02 15:04"), expires)
+		if t.Comment != "" {
+			line += " (" + t.Comment + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+// checkTokens validates the tokens section of the config
+func checkTokens(conf Config) error {
+	ids := make(map[string]bool)
+	for _, t := range conf.Tokens {
+		if ids[t.ID] {
+			return fmt.Errorf("duplicate token ID %s", t.ID)
+		}
+		ids[t.ID] = true
+		found := false
+		for _, d := range conf.Domains {
+			found = found || d.Name == t.Domain
+		}
+		if !found {
+			return fmt.Errorf("unknown domain %s for token %s", t.Domain, t.ID)
+		}
+		if t.Scope != ScopeRead && t.Scope != ScopeAdd && t.Scope != ScopeWrite {
+			return fmt.Errorf("invalid scope %q for token %s, expected read, add or write", t.Scope, t.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Two-factor authentication with RFC 6238 time-based one-time passwords, as
+// generated by authenticator apps. Users enroll with the -totp flag, which
+// also prints single-use recovery codes, stored hashed in the config file,
+// for when the app is lost. With session login, the code is entered in the
+// login form, with basic authentication it is typed right after the
+// password, as are recovery codes.
+
+const (
+	totpDigits   = 6
+	totpPeriod   = 30
+	totpIssuer   = "postmapweb"
+	recoveryKeys = 10
+	// recovery codes are shown as xxxxx-xxxxx
+	recoveryCodeLength = 10
+)
+
+var totp_state = struct {
+	sync.Mutex
+	// last time step used by each user, so codes cannot be replayed
+	last_step map[string]int64
+	// hashes of the recovery codes used since the config was read
+	used_recovery map[string]bool
+}{last_step: make(map[string]int64), used_recovery: make(map[string]bool)}
+
+// path of the config file, to remove used recovery codes from it
+var conf_path string
+
+var ErrInvalidCredentials = errors.New("invalid user name, password or authentication code")
+var ErrReusedCode = errors.New("the authentication code was already used")
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal("could not generate TOTP secret: ", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// totpCode returns the code of a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// verifyTOTP checks a code against the user's secret, allowing for one time
+// step of clock drift, and refuses codes already used
+func verifyTOTP(user User, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return false
+	}
+	now := time.Now().Unix() / totpPeriod
+	totp_state.Lock()
+	defer totp_state.Unlock()
+	for step := now - 1; step <= now+1; step++ {
+		expected, err := totpCode(user.TOTPSecret, step)
+		if err != nil {
+			log.Println("invalid TOTP secret for", user.Name, "due to", err)
+			return false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) && step > totp_state.last_step[user.Name] {
+			totp_state.last_step[user.Name] = step
+			return true
+		}
+	}
+	return false
+}
+
+// reusedTOTP tells whether a code is the one the user last logged in with
+func reusedTOTP(user User, code string) bool {
+	totp_state.Lock()
+	step, ok := totp_state.last_step[user.Name]
+	totp_state.Unlock()
+	if !ok {
+		return false
+	}
+	expected, err := totpCode(user.TOTPSecret, step)
+	return err == nil && hmac.Equal([]byte(expected), []byte(strings.TrimSpace(code)))
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// useRecoveryCode checks a recovery code of the user, and removes it from
+// the config file so it can only be used once
+func useRecoveryCode(user User, code string) bool {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false
+	}
+	totp_state.Lock()
+	defer totp_state.Unlock()
+	for _, hash := range user.RecoveryCodes {
+		if totp_state.used_recovery[hash] || bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+			continue
+		}
+		totp_state.used_recovery[hash] = true
+		log.Println("recovery code used by", user.Name)
+		err := removeRecoveryCode(user.Name, hash)
+		if err != nil {
+			log.Println("could not remove used recovery code of", user.Name, "from", conf_path, "due to", err)
+		}
+		return true
+	}
+	return false
+}
+
+// removeRecoveryCode rewrites the config file without a recovery code
+func removeRecoveryCode(name string, hash string) error {
+	data, err := os.ReadFile(conf_path)
+	if err != nil {
+		return err
+	}
+	var c Config
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return err
+	}
+	without := func(hashes []string) []string {
+		kept := make([]string, 0, len(hashes))
+		for _, h := range hashes {
+			if h != hash {
+				kept = append(kept, h)
+			}
+		}
+		return kept
+	}
+	for i := range c.Users {
+		if c.Users[i].Name == name {
+			c.Users[i].RecoveryCodes = without(c.Users[i].RecoveryCodes)
+		}
+	}
+	for i := range c.Domains {
+		if c.Domains[i].Name == name {
+			c.Domains[i].RecoveryCodes = without(c.Domains[i].RecoveryCodes)
+		}
+	}
+	data, err = json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := conf_path + ".new"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, conf_path)
+}
+
+// checkSecondFactor checks the code of a user with two-factor
+// authentication, or one of their recovery codes
+func checkSecondFactor(user User, code string) bool {
+	if user.TOTPSecret == "" {
+		return true
+	}
+	return verifyTOTP(user, code) || useRecoveryCode(user, code)
+}
+
+// authenticateBasic authenticates basic authentication credentials, where
+// users with two-factor authentication type their code, or a recovery code
+// with or without its dash, after the password. It returns ErrReusedCode if
+// the password is right but the code is the last one used, as browsers keep
+// sending it, otherwise ErrInvalidCredentials if the credentials are wrong.
+func authenticateBasic(name string, password string) (User, error) {
+	user, ok := findUser(name)
+	if !ok || user.TOTPSecret == "" {
+		user, ok = authenticate(name, password)
+		if !ok {
+			return User{}, ErrInvalidCredentials
+		}
+		return user, nil
+	}
+	if len(password) > totpDigits {
+		code := password[len(password)-totpDigits:]
+		user, ok = authenticate(name, password[:len(password)-totpDigits])
+		switch {
+		case ok && verifyTOTP(user, code):
+			return user, nil
+		case ok && reusedTOTP(user, code):
+			return User{}, ErrReusedCode
+		}
+	}
+	for _, n := range []int{recoveryCodeLength, recoveryCodeLength + 1} {
+		if len(password) <= n {
+			break
+		}
+		code := password[len(password)-n:]
+		if n > recoveryCodeLength && code[recoveryCodeLength/2] != '-' {
+			continue
+		}
+		user, ok = authenticate(name, password[:len(password)-n])
+		if ok && useRecoveryCode(user, code) {
+			return user, nil
+		}
+	}
+	return User{}, ErrInvalidCredentials
+}
+
+// enrollTOTP sets up two-factor authentication for a user or domain login,
+// for the -totp flag
+func enrollTOTP(conf Config, conf_file string, name string) {
+	user, ok := findUser(name)
+	if !ok {
+		log.Fatal("no such user: ", name)
+	}
+	secret := newTOTPSecret()
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + user.Name,
+		RawQuery: url.Values{
+			"secret": {secret},
+			"issuer": {totpIssuer},
+			"digits": {fmt.Sprint(totpDigits)},
+			"period": {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}
+	fmt.Println("Add this account to your authenticator app:")
+	fmt.Println()
+	fmt.Println("   ", uri.String())
+	fmt.Println()
+	if qrencode, err := exec.LookPath("qrencode"); err == nil {
+		cmd := exec.Command(qrencode, "-t", "UTF8", uri.String())
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Run()
+	} else {
+		fmt.Println("or enter the secret", secret, "(install qrencode to get a QR code)")
+	}
+	fmt.Print("\nEnter the code shown by the app to confirm: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	user.TOTPSecret = secret
+	if !verifyTOTP(user, line) {
+		log.Fatal("invalid code, two-factor authentication was not enabled")
+	}
+
+	codes := make([]string, 0, recoveryKeys)
+	hashes := make([]string, 0, recoveryKeys)
+	for i := 0; i < recoveryKeys; i++ {
+		code := strings.ToLower(newTOTPSecret()[:recoveryCodeLength])
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatal("Could not hash the recovery code: ", err)
+		}
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, string(hash))
+	}
+	setTOTP(&conf, name, secret, hashes)
+	writeConf(conf, conf_file)
+	fmt.Println("\nTwo-factor authentication is enabled. Keep these recovery codes in a")
+	fmt.Println("safe place, each can be used once instead of a code if the app is lost:")
+	fmt.Println()
+	for _, code := range codes {
+		fmt.Println("   ", code)
+	}
+	fmt.Println()
+}
+
+// setTOTP sets or clears the two-factor authentication of a user or domain
+// login
+func setTOTP(conf *Config, name string, secret string, recovery_codes []string) {
+	for i := range conf.Users {
+		if conf.Users[i].Name == name {
+			conf.Users[i].TOTPSecret = secret
+			conf.Users[i].RecoveryCodes = recovery_codes
+			return
+		}
+	}
+	for i := range conf.Domains {
+		if conf.Domains[i].Name == name {
+			conf.Domains[i].TOTPSecret = secret
+			conf.Domains[i].RecoveryCodes = recovery_codes
+			return
+		}
+	}
+	log.Fatal("no such user: ", name)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Map files are installed as a transaction: the new main and spam maps are
+// written and compiled in a staging directory next to the map file, then
+// swapped into place along with their compiled versions. If any stage fails,
+// both map files are rolled back to their previous state, so they never get
+// out of sync. Reloading Postfix and running the script hook are left to a
+// background job, see jobs.go.
+
+// Step is the outcome of one of the commands run to install map files or
+// in a post-processing job
+type Step struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+func newStep(name string, err error) Step {
+	if err != nil {
+		return Step{name, err.Error()}
+	}
+	return Step{Name: name}
+}
+
+// StageError reports which stage of installing map files failed
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Stage + " failed: " + e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+type mapTransaction struct {
+	domain     Domain
+	backend    MapBackend
+	dir        string
+	base       string
+	stage_dir  string
+	backup_dir string
+	// files swapped into place, and those whose previous version was saved
+	installed   []string
+	backed_up   []string
+	keep_backup bool
+	steps       []Step
+}
+
+func newMapTransaction(domain Domain) (*mapTransaction, error) {
+	backend, err := mapBackend(domain)
+	if err != nil {
+		return nil, err
+	}
+	dir, base := filepath.Split(domain.MapFile)
+	return &mapTransaction{
+		domain:     domain,
+		backend:    backend,
+		dir:        dir,
+		base:       base,
+		stage_dir:  filepath.Join(dir, "."+base+".web.new"),
+		backup_dir: filepath.Join(dir, "."+base+".web.old"),
+	}, nil
+}
+
+// prepare writes the new map files to the staging directory
+func (t *mapTransaction) prepare(map_data []byte, spam_data []byte) error {
+	// clean up after any transaction interrupted by a crash
+	os.RemoveAll(t.stage_dir)
+	err := os.MkdirAll(t.stage_dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(t.stage_dir, t.base), map_data, 0644)
+	if err != nil {
+		return err
+	}
+	// recipient of "spam" goes to its own file
+	return os.WriteFile(filepath.Join(t.stage_dir, t.base+".spam"), spam_data, 0644)
+}
+
+// compile builds the lookup tables for the staged map files with the
+// domain's map backend, a map that fails to compile is kept with a .bad
+// suffix for troubleshooting
+func (t *mapTransaction) compile() error {
+	for _, name := range []string{t.base, t.base + ".spam"} {
+		staged := filepath.Join(t.stage_dir, name)
+		err := t.backend.Compile(staged)
+		t.steps = append(t.steps, newStep(t.backend.Name()+" "+name, err))
+		if err != nil {
+			log.Println("error compiling", staged, "with", t.backend.Name(), "due to", err)
+			os.Rename(staged, filepath.Join(t.dir, name+".bad"))
+			return err
+		}
+	}
+	return nil
+}
+
+// backupFile keeps a copy of a file in the backup directory, as a hard link
+// if possible, so the file itself stays in place until it is replaced
+func (t *mapTransaction) backupFile(name string) error {
+	target := filepath.Join(t.dir, name)
+	backup := filepath.Join(t.backup_dir, name)
+	if os.Link(target, backup) == nil {
+		return nil
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(backup, data, info.Mode().Perm())
+}
+
+// swap renames the staged files and their compiled versions over the files
+// they replace, after saving those to the backup directory, so readers
+// always see either the previous or the new version of every file
+func (t *mapTransaction) swap() error {
+	staged, err := os.ReadDir(t.stage_dir)
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(t.backup_dir)
+	err = os.MkdirAll(t.backup_dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, entry := range staged {
+		name := entry.Name()
+		target := filepath.Join(t.dir, name)
+		if _, err := os.Lstat(target); err == nil {
+			err = t.backupFile(name)
+			if err != nil {
+				t.rollback()
+				return err
+			}
+			t.backed_up = append(t.backed_up, name)
+		}
+		err = os.Rename(filepath.Join(t.stage_dir, name), target)
+		if err != nil {
+			t.rollback()
+			return err
+		}
+		t.installed = append(t.installed, name)
+	}
+	return nil
+}
+
+// rollback restores the files replaced by swap
+func (t *mapTransaction) rollback() {
+	log.Println("rolling back changes to", t.domain.MapFile)
+	backed_up := make(map[string]bool)
+	for _, name := range t.backed_up {
+		backed_up[name] = true
+	}
+	for _, name := range t.installed {
+		if !backed_up[name] {
+			os.Remove(filepath.Join(t.dir, name))
+		}
+	}
+	for _, name := range t.backed_up {
+		err := os.Rename(filepath.Join(t.backup_dir, name), filepath.Join(t.dir, name))
+		if err != nil {
+			log.Println("could not restore", name, "from", t.backup_dir, "due to", err)
+			t.keep_backup = true
+		}
+	}
+	t.installed = nil
+	t.backed_up = nil
+}
+
+// commit keeps the previous text maps with a .old suffix
+func (t *mapTransaction) commit() {
+	for _, name := range []string{t.base, t.base + ".spam"} {
+		os.Rename(filepath.Join(t.backup_dir, name), filepath.Join(t.dir, name+".old"))
+	}
+}
+
+func (t *mapTransaction) cleanup() {
+	os.RemoveAll(t.stage_dir)
+	if t.keep_backup {
+		log.Println("keeping previous map files in", t.backup_dir, "for manual recovery")
+		return
+	}
+	os.RemoveAll(t.backup_dir)
+}
+
+// installMapFiles replaces the domain's map and spam map files with the
+// given contents and compiles them with the domain's map backend. On failure, a *StageError
+// says which stage failed.
+//
+// The caller must hold the map lock, see lockMap.
+func installMapFiles(domain Domain, map_data []byte, spam_data []byte) ([]Step, error) {
+	t, err := newMapTransaction(domain)
+	if err != nil {
+		return nil, &StageError{"prepare", err}
+	}
+	defer t.cleanup()
+	err = t.prepare(map_data, spam_data)
+	if err != nil {
+		return t.steps, &StageError{"prepare", err}
+	}
+	err = t.compile()
+	if err != nil {
+		return t.steps, &StageError{"compile", err}
+	}
+	err = t.swap()
+	if err != nil {
+		return t.steps, &StageError{"swap", err}
+	}
+	t.commit()
+	return t.steps, nil
+}
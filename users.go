@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users and roles: each user has their own password and is granted a role
+// on one or more domains. The password of a domain in the Domains section
+// still works, as an admin of that domain named after it.
+
+const (
+	// can only see and change the aliases of their own address, the user
+	// name, or that forward to it
+	RoleSelf = "self"
+	// can look at the aliases, their history and usage
+	RoleViewer = "viewer"
+	// can also change the aliases and restore earlier versions
+	RoleEditor = "editor"
+	// can also read the audit log
+	RoleAdmin = "admin"
+)
+
+var roleLevels = map[string]int{RoleSelf: 1, RoleViewer: 2, RoleEditor: 3, RoleAdmin: 4}
+
+// a grant on AllDomains applies to every configured domain, admins of all
+// domains also get the dashboard, see dashboard.go
+const AllDomains = "*"
+
+var ErrNoSuchDomain = errors.New("no such domain")
+
+// Grant gives a user a role on a domain, or only on the aliases whose local
+// part matches Pattern, see scope.go
+type Grant struct {
+	Domain  string
+	Role    string
+	Pattern string `json:",omitempty"`
+}
+
+type User struct {
+	Name     string
+	PassHash string
+	Grants   []Grant
+	// two-factor authentication, see totp.go
+	TOTPSecret    string   `json:",omitempty"`
+	RecoveryCodes []string `json:",omitempty"`
+}
+
+// cookie remembering the domain selected in the web interface
+const domainCookie = "postmapweb_domain"
+
+// checkUsers validates the users section of the config
+func checkUsers(conf Config) error {
+	seen := make(map[string]bool)
+	for _, u := range conf.Users {
+		if u.Name == "" || seen[u.Name] {
+			return fmt.Errorf("missing or duplicate user name %q", u.Name)
+		}
+		seen[u.Name] = true
+		for _, g := range u.Grants {
+			if roleLevels[g.Role] == 0 {
+				return fmt.Errorf("unknown role %q for user %s, expected self, viewer, editor or admin", g.Role, u.Name)
+			}
+			if _, err := path.Match(g.Pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q for user %s: %v", g.Pattern, u.Name, err)
+			}
+			if g.Pattern != "" && (g.Role == RoleSelf || g.Domain == AllDomains) {
+				return fmt.Errorf("user %s can only have a pattern on a single domain, and not with the self role", u.Name)
+			}
+			if g.Role == RoleSelf && !strings.HasSuffix(strings.ToLower(u.Name), "@"+strings.ToLower(g.Domain)) {
+				return fmt.Errorf("user %s can only have the self role on the domain of their address, not %s", u.Name, g.Domain)
+			}
+			found := g.Domain == AllDomains
+			for _, d := range conf.Domains {
+				found = found || d.Name == g.Domain
+			}
+			if !found {
+				return fmt.Errorf("unknown domain %s for user %s", g.Domain, u.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseGrants parses the -g flag: domain:role[:pattern][,domain:role...]
+func parseGrants(spec string) ([]Grant, error) {
+	var grants []Grant
+	for _, item := range strings.Split(spec, ",") {
+		domain, role, ok := strings.Cut(strings.TrimSpace(item), ":")
+		role, pattern, _ := strings.Cut(role, ":")
+		if !ok || domain == "" || roleLevels[role] == 0 {
+			return nil, fmt.Errorf("invalid grant %q, expected domain:role[:pattern] where role is self, viewer, editor or admin", item)
+		}
+		grants = append(grants, Grant{domain, role, pattern})
+	}
+	return grants, nil
+}
+
+// updateUser adds a user to the config file, or changes the password of an
+// existing one, replacing their grants if any are given
+func updateUser(conf Config, conf_file string, name string, grant_spec string, password []byte) {
+	var grants []Grant
+	if grant_spec != "" {
+		var err error
+		grants, err = parseGrants(grant_spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	pass_hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("Could not hash the password: ", err)
+	}
+	existing := false
+	for i, u := range conf.Users {
+		if u.Name == name {
+			existing = true
+			conf.Users[i].PassHash = string(pass_hash)
+			if grants != nil {
+				conf.Users[i].Grants = grants
+			}
+		}
+	}
+	if !existing {
+		conf.Users = append(conf.Users, User{Name: name, PassHash: string(pass_hash), Grants: grants})
+	}
+	err = checkUsers(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeConf(conf, conf_file)
+}
+
+// authenticate returns the user with the given credentials
+func authenticate(name string, password string) (User, bool) {
+	user, ok := findUser(name)
+	if !ok {
+		return User{}, false
+	}
+	return user, bcrypt.CompareHashAndPassword([]byte(user.PassHash), []byte(password)) == nil
+}
+
+// findConfiguredUser returns the named user from the users section
+func findConfiguredUser(name string) (User, bool) {
+	for _, u := range conf.Users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// findUser returns the named user from the users section, or a domain
+// user
+func findUser(name string) (User, bool) {
+	if u, ok := findConfiguredUser(name); ok {
+		return u, true
+	}
+	for _, d := range conf.Domains {
+		if d.Name == name && d.PassHash != "" {
+			return domainUser(d), true
+		}
+	}
+	return User{}, false
+}
+
+// domainUser is the user authenticating with a domain's password
+func domainUser(d Domain) User {
+	return User{
+		Name:          d.Name,
+		PassHash:      d.PassHash,
+		Grants:        []Grant{{d.Name, RoleAdmin, ""}},
+		TOTPSecret:    d.TOTPSecret,
+		RecoveryCodes: d.RecoveryCodes,
+	}
+}
+
+func findDomain(name string) (Domain, bool) {
+	for _, d := range conf.Domains {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Domain{}, false
+}
+
+// grantedRole returns the user's role on a domain, or "" if they have none
+func grantedRole(user User, name string) string {
+	role := ""
+	for _, g := range user.Grants {
+		if (g.Domain == name || g.Domain == AllDomains) && roleLevels[g.Role] > roleLevels[role] {
+			role = g.Role
+		}
+	}
+	return role
+}
+
+// grantedPatterns returns the patterns of the aliases the user has the role
+// on, or nil if they have it on the whole domain
+func grantedPatterns(user User, name string, role string) []string {
+	var patterns []string
+	for _, g := range user.Grants {
+		if (g.Domain == name || g.Domain == AllDomains) && roleLevels[g.Role] >= roleLevels[role] {
+			if g.Pattern == "" {
+				return nil
+			}
+			patterns = append(patterns, g.Pattern)
+		}
+	}
+	return patterns
+}
+
+// userDomains lists the domains the user was granted a role on
+func userDomains(user User) []string {
+	names := make([]string, 0, len(user.Grants))
+	for _, g := range user.Grants {
+		if g.Domain == AllDomains && roleLevels[g.Role] > 0 {
+			names = names[:0]
+			for _, d := range conf.Domains {
+				names = append(names, d.Name)
+			}
+			return names
+		}
+		if _, ok := findDomain(g.Domain); ok && roleLevels[g.Role] > 0 && !slices.Contains(names, g.Domain) {
+			names = append(names, g.Domain)
+		}
+	}
+	return names
+}
+
+// isSuperAdmin tells whether the user is an admin of all domains
+func isSuperAdmin(user User) bool {
+	for _, g := range user.Grants {
+		if g.Domain == AllDomains && g.Role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// setDomain makes the named domain the one the request applies to, if the
+// user has a role on it
+func setDomain(c echo.Context, name string) error {
+	user := c.Get("user").(User)
+	role := grantedRole(user, name)
+	d, ok := findDomain(name)
+	if role == "" || !ok {
+		return ErrNoSuchDomain
+	}
+	c.Set("domain", d)
+	c.Set("role", role)
+	c.Set("patterns", grantedPatterns(user, name, role))
+	return nil
+}
+
+// selectDomain picks the domain of a web request: the domain parameter, then
+// the one selected earlier, then the first one the user has a role on
+func selectDomain(c echo.Context) error {
+	if name := c.FormValue("domain"); name != "" {
+		err := setDomain(c, name)
+		if err != nil {
+			return err
+		}
+		c.SetCookie(&http.Cookie{
+			Name:     domainCookie,
+			Value:    name,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		return nil
+	}
+	if cookie, err := c.Cookie(domainCookie); err == nil && setDomain(c, cookie.Value) == nil {
+		return nil
+	}
+	if names := userDomains(c.Get("user").(User)); len(names) > 0 {
+		return setDomain(c, names[0])
+	}
+	return ErrNoSuchDomain
+}
+
+// SelectDomain sets the domain and the user's role on it for the web
+// interface, the API takes the domain from the URL instead, see APIDomain,
+// and the dashboard is not about any one domain
+func SelectDomain(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Get("user") == nil || strings.HasPrefix(c.Path(), "/api/") || c.Path() == "/dashboard" {
+			return next(c)
+		}
+		err := selectDomain(c)
+		if err != nil {
+			return c.Render(http.StatusForbidden, "error", ErrorPage{"you do not have access to this domain", nil})
+		}
+		return next(c)
+	}
+}
+
+// hasRole tells whether the request's user has at least the given role on
+// its domain. The self role is not part of that order: only self users have
+// it, and they have no other.
+func hasRole(c echo.Context, role string) bool {
+	granted, _ := c.Get("role").(string)
+	if granted == RoleSelf || role == RoleSelf {
+		return granted == role
+	}
+	return roleLevels[granted] >= roleLevels[role]
+}
+
+// canChange tells whether the request's user can change any aliases
+func canChange(c echo.Context) bool {
+	return hasRole(c, RoleEditor) || hasRole(c, RoleSelf)
+}
+
+// RequireRole refuses requests from users without at least one of the
+// given roles on the domain
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, role := range roles {
+				if hasRole(c, role) {
+					return next(c)
+				}
+			}
+			msg := "you need to be " + strings.Join(roles, " or ") + " of " + c.Get("domain").(Domain).Name + " to do this"
+			if strings.HasPrefix(c.Path(), "/api/") {
+				return apiError(c, http.StatusForbidden, msg)
+			}
+			return c.Render(http.StatusForbidden, "error", ErrorPage{msg, nil})
+		}
+	}
+}
+
+// RequireSuperAdmin refuses requests from users who are not admins of all
+// domains
+func RequireSuperAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isSuperAdmin(c.Get("user").(User)) {
+			return next(c)
+		}
+		msg := "you need to be an admin of all domains to do this"
+		if strings.HasPrefix(c.Path(), "/api/") {
+			return apiError(c, http.StatusForbidden, msg)
+		}
+		return c.Render(http.StatusForbidden, "error", ErrorPage{msg, nil})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Optimistic concurrency control: every view of a map carries the version
+// of the map and spam files it was read from, and changes based on an older
+// version are rejected instead of silently overwriting someone else's edits.
+
+var ErrMissingVersion = errors.New("missing map version, please reload the page and try again")
+var ErrStaleVersion = errors.New("the aliases were changed by someone else since you loaded them, please reload the page and try again")
+
+// domainEntries returns the lines of the main and spam maps that define the
+// domain's own aliases, leaving out comments and the entries of other
+// domains sharing the map file
+func domainEntries(domain Domain, map_data []byte, spam_data []byte) ([]byte, []byte, error) {
+	var map_buf, spam_buf bytes.Buffer
+	keep := func(buf *bytes.Buffer) func(line string, email string) {
+		return func(line string, email string) {
+			if inDomain(email, domain) {
+				buf.WriteString(line + "\n")
+			}
+		}
+	}
+	_, err := readSingleMap(map_data, false, keep(&map_buf))
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = readSingleMap(spam_data, true, keep(&spam_buf))
+	return map_buf.Bytes(), spam_buf.Bytes(), err
+}
+
+// mapVersion returns an opaque version identifier for a domain's aliases,
+// derived from a hash of its entries in the main and spam maps, so changes
+// to other domains sharing the map file do not make it stale
+func mapVersion(domain Domain) (string, error) {
+	map_data, spam_data, err := loadMaps(domain)
+	if err != nil {
+		return "", err
+	}
+	map_data, spam_data, err = domainEntries(domain, map_data, spam_data)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(map_data)
+	h.Write([]byte{0})
+	h.Write(spam_data)
+	h.Write([]byte{0})
+	return hex.EncodeToString(h.Sum(nil)[:12]), nil
+}
+
+// recently served versions, so a conflict can be reported alias by alias
+const maxSnapshots = 64
+
+var snapshots = struct {
+	sync.Mutex
+	// by domain and version, see snapshotKey
+	aliases map[string][]Alias
+	order   []string
+}{aliases: make(map[string][]Alias)}
+
+func snapshotKey(domain Domain, version string) string {
+	return domain.Name + " " + version
+}
+
+func rememberSnapshot(domain Domain, version string, aliases []Alias) {
+	snapshots.Lock()
+	defer snapshots.Unlock()
+	key := snapshotKey(domain, version)
+	if _, ok := snapshots.aliases[key]; ok {
+		return
+	}
+	snapshots.aliases[key] = aliases
+	snapshots.order = append(snapshots.order, key)
+	if len(snapshots.order) > maxSnapshots {
+		delete(snapshots.aliases, snapshots.order[0])
+		snapshots.order = snapshots.order[1:]
+	}
+}
+
+func snapshot(domain Domain, version string) ([]Alias, bool) {
+	snapshots.Lock()
+	defer snapshots.Unlock()
+	aliases, ok := snapshots.aliases[snapshotKey(domain, version)]
+	return aliases, ok
+}
+
+// currentAliases returns the domain's aliases along with the version of the
+// map files they were read from.
+//
+// The caller must hold the map lock, see lockMap.
+func currentAliases(domain Domain) ([]Alias, string, error) {
+	version, err := mapVersion(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	aliases, err := domainAliases(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	rememberSnapshot(domain, version, aliases)
+	return aliases, version, nil
+}
+
+// changedAliases lists the aliases that differ between two versions of a
+// domain's aliases, formatted for display
+func changedAliases(before []Alias, after []Alias) []string {
+	old := make(map[string]string)
+	for _, a := range before {
+		old[a.Email] = a.Target
+	}
+	changed := make([]string, 0)
+	for _, a := range after {
+		target, ok := old[a.Email]
+		switch {
+		case !ok:
+			changed = append(changed, a.Email+" added → "+a.Target)
+		case target != a.Target:
+			changed = append(changed, a.Email+" changed "+target+" → "+a.Target)
+		}
+		delete(old, a.Email)
+	}
+	for email, target := range old {
+		changed = append(changed, email+" removed (was "+target+")")
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// checkVersion verifies that changes based on version can be applied to the
+// domain's map, otherwise it returns ErrMissingVersion or ErrStaleVersion
+// and, if the version is still known, the aliases in the user's scope
+// changed since.
+//
+// The caller must hold the map lock, see lockMap.
+func checkVersion(domain Domain, version string, scope aliasScope) ([]string, error) {
+	if version == "" {
+		return nil, ErrMissingVersion
+	}
+	aliases, current, err := currentAliases(domain)
+	if err != nil {
+		return nil, err
+	}
+	if version == current {
+		return nil, nil
+	}
+	before, ok := snapshot(domain, version)
+	if !ok {
+		return nil, ErrStaleVersion
+	}
+	return changedAliases(scope.filter(before), scope.filter(aliases)), ErrStaleVersion
+}
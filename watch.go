@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Detection of changes made to the map files behind postmapweb's back, e.g.
+// by hand: the configured map files are watched for changes, which
+// invalidates the cached versions used to warn users that the aliases they
+// are looking at are out of date.
+
+var map_versions = struct {
+	sync.Mutex
+	watching bool
+	// by map file, then domain
+	cache map[string]map[string]string
+}{cache: make(map[string]map[string]string)}
+
+// watchedFiles returns the map and spam map files of the domains, mapped to
+// the main map file they belong to
+func watchedFiles(domains []Domain) map[string]string {
+	files := make(map[string]string)
+	for _, d := range domains {
+		files[filepath.Clean(d.MapFile)] = d.MapFile
+		files[filepath.Clean(d.MapFile+".spam")] = d.MapFile
+	}
+	return files
+}
+
+// mapChanged is called by the watcher when a map file changed
+func mapChanged(map_file string) {
+	map_versions.Lock()
+	delete(map_versions.cache, map_file)
+	map_versions.Unlock()
+	if *verbose {
+		log.Println("map file changed:", map_file)
+	}
+	// the map lock may be held by the caller
+	go reindexMapFile(map_file)
+}
+
+// cachedMapVersion is like mapVersion, but avoids rehashing unchanged map
+// files when they are being watched. It must not be used to validate
+// changes, as events may be missed.
+func cachedMapVersion(domain Domain) (string, error) {
+	map_versions.Lock()
+	defer map_versions.Unlock()
+	if version, ok := map_versions.cache[domain.MapFile][domain.Name]; ok {
+		return version, nil
+	}
+	version, err := mapVersion(domain)
+	if err == nil && map_versions.watching {
+		if map_versions.cache[domain.MapFile] == nil {
+			map_versions.cache[domain.MapFile] = make(map[string]string)
+		}
+		map_versions.cache[domain.MapFile][domain.Name] = version
+	}
+	return version, err
+}
+
+// startWatching watches the domains' map files for changes, if that is not
+// possible map versions are simply not cached
+func startWatching(domains []Domain) {
+	err := watchMaps(watchedFiles(domains))
+	if err != nil {
+		log.Println("not watching map files for changes due to", err)
+		return
+	}
+	map_versions.Lock()
+	map_versions.watching = true
+	map_versions.Unlock()
+}
+
+// Version returns the current version of the domain's map, so the view can
+// warn when it was changed since the page was loaded
+func Version(c echo.Context) error {
+	domain := c.Get("domain").(Domain)
+	version, err := cachedMapVersion(domain)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Version string `json:"version"`
+	}{version})
+}
+
+// checkMaps reports text maps that are not compiled, or whose compiled
+// version is older than the text, returning false if there are any
+func checkMaps(domains []Domain) bool {
+	ok := true
+	checked := make(map[string]bool)
+	for _, d := range domains {
+		for _, problem := range mapProblems(d, checked) {
+			log.Println(problem)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// mapProblems describes what is wrong with the domain's map files, skipping
+// the files already in checked
+func mapProblems(d Domain, checked map[string]bool) []string {
+	var problems []string
+	if d.MapType == "sqlite" {
+		// queried directly by Postfix
+		return nil
+	}
+	backend, err := mapBackend(d)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	suffixes := backend.Suffixes()
+	map_type := d.MapType
+	if map_type == "" {
+		map_type = defaultMapType
+	}
+	for _, map_file := range []string{d.MapFile, d.MapFile + ".spam"} {
+		if checked[map_file] {
+			continue
+		}
+		checked[map_file] = true
+		text, err := os.Stat(map_file)
+		if err != nil {
+			if map_file == d.MapFile {
+				problems = append(problems, fmt.Sprint("map file of ", d.Name, " is missing: ", err))
+			}
+			continue
+		}
+		compiled := len(suffixes) == 0
+		for _, suffix := range suffixes {
+			db, err := os.Stat(map_file + suffix)
+			if err != nil {
+				continue
+			}
+			compiled = true
+			if db.ModTime().Before(text.ModTime()) {
+				problems = append(problems, "map file "+map_file+" was changed after "+map_file+suffix+" was compiled, run postmap "+map_type+":"+map_file)
+			}
+		}
+		if !compiled {
+			problems = append(problems, "map file "+map_file+" has not been compiled, run postmap "+map_type+":"+map_file)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMaps uses inotify to watch the directories holding the map files,
+// as they are replaced rather than modified in place
+func watchMaps(files map[string]string) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[int]string)
+	watched := make(map[string]bool)
+	for file_name := range files {
+		dir := filepath.Dir(file_name)
+		if watched[dir] {
+			continue
+		}
+		wd, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_MOVED_FROM|unix.IN_CREATE|unix.IN_DELETE)
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+		dirs[wd] = dir
+		watched[dir] = true
+	}
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := unix.Read(fd, buf)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Println("stopped watching map files due to", err)
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				name_start := offset + unix.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[name_start:name_start+int(event.Len)]), "\x00")
+				offset = name_start + int(event.Len)
+				if map_file, ok := files[filepath.Join(dirs[int(event.Wd)], name)]; ok {
+					mapChanged(map_file)
+				}
+			}
+		}
+	}()
+	return nil
+}
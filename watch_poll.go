@@ -0,0 +1,38 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const pollInterval = 5 * time.Second
+
+// watchMaps polls the map files for changes on platforms without inotify
+func watchMaps(files map[string]string) error {
+	stat := func(file_name string) string {
+		info, err := os.Stat(file_name)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprint(info.ModTime().UnixNano(), info.Size())
+	}
+	last := make(map[string]string)
+	for file_name := range files {
+		last[file_name] = stat(file_name)
+	}
+	go func() {
+		for range time.Tick(pollInterval) {
+			for file_name, map_file := range files {
+				current := stat(file_name)
+				if current != last[file_name] {
+					last[file_name] = current
+					mapChanged(map_file)
+				}
+			}
+		}
+	}()
+	return nil
+}